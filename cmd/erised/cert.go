@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// runCert implements the cert subcommand, creating a CA or a leaf certificate and its private key
+func runCert(args []string) error {
+	log.Debug().Msg("entering runCert")
+	flg := flag.NewFlagSet("cert", flag.ContinueOnError)
+	isCA := flg.Bool("ca", false, "create a CA certificate instead of a leaf certificate")
+	commonName := flg.String("cn", "", "certificate common name. Default is the first host, or Erised CA with -ca")
+	days := flg.Int("days", 365, "number of days the certificate is valid for")
+	hosts := flg.String("hosts", strings.Join(localHosts, ","), "comma separated DNS names, IP addresses, email addresses or URIs the certificate is issued for")
+	issuerCert := flg.String("issuer-cert", "", "path to the CA certificate signing the new certificate. Self-signed if omitted")
+	issuerKey := flg.String("issuer-key", "", "path to the CA private key, used with -issuer-cert")
+	keyBits := flg.Int("key-bits", 0, "key size. Default is 2048 for rsa and 256 for ecdsa")
+	keyType := flg.String("key-type", keyECDSA, "one of rsa/ecdsa/ed25519")
+	out := flg.String("out", "erised", "base name of the files to write. The certificate goes to <out>.crt and the key to <out>.key")
+	start := flg.String("start", "", "date the certificate becomes valid from, as YYYY-MM-DD or RFC 3339. Default is now")
+
+	flg.Usage = func() {
+		fmt.Println("Creates X.509 certificates and private keys for erised and its clients (" + version + ")")
+		fmt.Println("\nerised cert [options]")
+		fmt.Println("\nParameters:")
+		flg.PrintDefaults()
+		fmt.Println()
+	}
+
+	if err := flg.Parse(args); err != nil {
+		return err
+	}
+
+	if (*issuerCert == "") != (*issuerKey == "") {
+		return errors.New("-issuer-cert and -issuer-key must be used together")
+	}
+
+	if *days <= 0 {
+		return errors.New("-days must be greater than zero")
+	}
+
+	spec := certSpec{CommonName: *commonName, KeyType: strings.ToLower(*keyType), KeyBits: *keyBits, IsCA: *isCA}
+
+	for _, host := range strings.Split(*hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			spec.Hosts = append(spec.Hosts, host)
+		}
+	}
+
+	if *isCA {
+		spec.Hosts = nil
+
+		if spec.CommonName == "" {
+			spec.CommonName = "Erised CA"
+		}
+	} else if spec.CommonName == "" && len(spec.Hosts) > 0 {
+		spec.CommonName = spec.Hosts[0]
+	}
+
+	if *start != "" {
+		var err error
+
+		if spec.NotBefore, err = time.Parse(time.DateOnly, *start); err != nil {
+			if spec.NotBefore, err = time.Parse(time.RFC3339, *start); err != nil {
+				return errors.New("invalid -start date " + *start)
+			}
+		}
+	} else {
+		spec.NotBefore = time.Now().Add(-time.Hour)
+	}
+
+	spec.NotAfter = spec.NotBefore.AddDate(0, 0, *days)
+	var issuer *certificate
+
+	if *issuerCert != "" {
+		var err error
+
+		if issuer, err = loadCertificate(*issuerCert, *issuerKey); err != nil {
+			return err
+		}
+	}
+
+	crt, err := newCertificate(spec, issuer)
+
+	if err != nil {
+		return err
+	}
+
+	if err = crt.write(*out+".crt", *out+".key"); err != nil {
+		return err
+	}
+
+	fmt.Println("Certificate written to " + *out + ".crt and private key to " + *out + ".key")
+	log.Debug().Msg("leaving runCert")
+	return nil
+}
+
+// loadCertificate reads a PEM encoded certificate and its private key, to sign other certificates
+func loadCertificate(certFile, keyFile string) (*certificate, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !cert.IsCA {
+		return nil, errors.New(certFile + " is not a CA certificate")
+	}
+
+	key, ok := pair.PrivateKey.(crypto.Signer)
+
+	if !ok {
+		return nil, errors.New("unsupported private key in " + keyFile)
+	}
+
+	return &certificate{cert: cert, key: key}, nil
+}
+
+// write saves the certificate and its private key, the key being readable by the owner only
+func (c *certificate) write(certFile, keyFile string) error {
+	key, err := c.keyPEM()
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.WriteFile(certFile, c.certPEM(), 0644); err != nil {
+		return err
+	}
+
+	return os.WriteFile(keyFile, key, 0600)
+}
+
+// autoCert creates a CA and a localhost certificate issued by it in dir, so HTTPS can be used without
+// setting up certificates. Clients can trust the returned CA file
+func autoCert(dir string) (certFile, keyFile, caFile string, err error) {
+	log.Debug().Msg("entering autoCert")
+	ca, err := newCertificate(certSpec{CommonName: "Erised Ephemeral CA", IsCA: true}, nil)
+
+	if err != nil {
+		return "", "", "", err
+	}
+
+	leaf, err := newCertificate(certSpec{CommonName: "localhost", Hosts: localHosts}, ca)
+
+	if err != nil {
+		return "", "", "", err
+	}
+
+	certFile, keyFile, caFile = filepath.Join(dir, "erised.crt"), filepath.Join(dir, "erised.key"), filepath.Join(dir, "erisedCA.pem")
+
+	if err = leaf.write(certFile, keyFile); err != nil {
+		return "", "", "", err
+	}
+
+	if err = os.WriteFile(caFile, ca.certPEM(), 0644); err != nil {
+		return "", "", "", err
+	}
+
+	log.Debug().Msg("leaving autoCert")
+	return certFile, keyFile, caFile, nil
+}
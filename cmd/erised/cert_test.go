@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+)
+
+func TestErisedCert(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	dir := t.TempDir()
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	g.Describe("Test key generation", func() {
+		g.It("Should generate every key type", func() {
+			key, err := generateKey(keyRSA, 0)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(key.(*rsa.PrivateKey).N.BitLen()).Should(Equal(2048))
+
+			key, err = generateKey(keyECDSA, 384)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(key.(*ecdsa.PrivateKey).Curve.Params().Name).Should(Equal("P-384"))
+
+			key, err = generateKey(keyEd25519, 0)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(key).Should(BeAssignableToTypeOf(ed25519.PrivateKey{}))
+		})
+
+		g.It("Should reject invalid keys", func() {
+			_, err := generateKey("dsa", 0)
+			Ω(err).Should(HaveOccurred())
+
+			_, err = generateKey(keyECDSA, 128)
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	g.Describe("Test erised cert", func() {
+		g.It("Should create a CA", func() {
+			Ω(runCert([]string{"-ca", "-cn", "Test CA", "-key-type", "rsa", "-out", path("ca")})).Should(Succeed())
+			ca, err := loadCertificate(path("ca.crt"), path("ca.key"))
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ca.cert.Subject.CommonName).Should(Equal("Test CA"))
+			Ω(ca.cert.DNSNames).Should(BeEmpty())
+
+			info, _ := os.Stat(path("ca.key"))
+			Ω(info.Mode().Perm()).Should(Equal(os.FileMode(0600)))
+		})
+
+		g.It("Should create leaf certificates issued by the CA", func() {
+			Ω(runCert([]string{"-issuer-cert", path("ca.crt"), "-issuer-key", path("ca.key"), "-key-type", "ed25519",
+				"-hosts", "example.test, 10.0.0.1,erised@example.test,spiffe://example.test/erised", "-out", path("leaf")})).Should(Succeed())
+			pair, err := tls.LoadX509KeyPair(path("leaf.crt"), path("leaf.key"))
+			Ω(err).ShouldNot(HaveOccurred())
+			leaf, _ := x509.ParseCertificate(pair.Certificate[0])
+			ca, _ := loadCertificate(path("ca.crt"), path("ca.key"))
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.cert)
+
+			Ω(leaf.Subject.CommonName).Should(Equal("example.test"))
+			Ω(leaf.DNSNames).Should(Equal([]string{"example.test"}))
+			Ω(leaf.IPAddresses[0].String()).Should(Equal("10.0.0.1"))
+			Ω(leaf.EmailAddresses).Should(Equal([]string{"erised@example.test"}))
+			Ω(leaf.URIs[0].String()).Should(Equal("spiffe://example.test/erised"))
+			Ω(leaf.PublicKeyAlgorithm).Should(Equal(x509.Ed25519))
+			_, err = leaf.Verify(x509.VerifyOptions{DNSName: "example.test", Roots: roots})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		g.It("Should set the validity period", func() {
+			Ω(runCert([]string{"-start", "2020-01-01", "-days", "2", "-out", path("old")})).Should(Succeed())
+			pair, _ := tls.LoadX509KeyPair(path("old.crt"), path("old.key"))
+			cert, _ := x509.ParseCertificate(pair.Certificate[0])
+
+			Ω(cert.NotBefore).Should(Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)))
+			Ω(cert.NotAfter).Should(Equal(time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)))
+			Ω(cert.Issuer.CommonName).Should(Equal("localhost"))
+		})
+
+		g.It("Should reject invalid options", func() {
+			Ω(runCert([]string{"-issuer-cert", path("ca.crt"), "-out", path("bad")})).ShouldNot(Succeed())
+			Ω(runCert([]string{"-issuer-cert", path("leaf.crt"), "-issuer-key", path("leaf.key"), "-out", path("bad")})).ShouldNot(Succeed())
+			Ω(runCert([]string{"-days", "0", "-out", path("bad")})).ShouldNot(Succeed())
+			Ω(runCert([]string{"-start", "yesterday", "-out", path("bad")})).ShouldNot(Succeed())
+			Ω(runCert([]string{"-key-type", "dsa", "-out", path("bad")})).ShouldNot(Succeed())
+			Ω(path("bad.crt")).ShouldNot(BeAnExistingFile())
+		})
+	})
+
+	g.Describe("Test automatic certificates", func() {
+		g.It("Should serve HTTPS with an ephemeral certificate", func() {
+			certFile, keyFile, caFile, err := autoCert(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+			pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+			Ω(err).ShouldNot(HaveOccurred())
+			pem, _ := os.ReadFile(caFile)
+			roots := x509.NewCertPool()
+			Ω(roots.AppendCertsFromPEM(pem)).Should(BeTrue())
+
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {}))
+			ts.TLS = &tls.Config{Certificates: []tls.Certificate{pair}}
+			ts.StartTLS()
+			defer ts.Close()
+
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+			res, err := client.Get(ts.URL)
+			Ω(err).ShouldNot(HaveOccurred())
+			_ = res.Body.Close()
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+		})
+	})
+}
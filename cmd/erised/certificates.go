@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	keyRSA     = "rsa"
+	keyECDSA   = "ecdsa"
+	keyEd25519 = "ed25519"
+)
+
+// hosts covered by the certificates generated for the local machine
+var localHosts = []string{"localhost", "127.0.0.1", "::1"}
+
+// certSpec describes a certificate to create. Hosts can be DNS names, IP addresses, email addresses or URIs
+type certSpec struct {
+	CommonName string
+	Hosts      []string
+	NotBefore  time.Time
+	NotAfter   time.Time
+	KeyType    string
+	KeyBits    int
+	IsCA       bool
+}
+
+type certificate struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// generateKey creates an RSA key of the given bits (2048 by default), an ECDSA key on the P-256, P-384 or
+// P-521 curve (P-256 by default) or an Ed25519 key
+func generateKey(keyType string, bits int) (crypto.Signer, error) {
+	switch keyType {
+	case keyRSA:
+		if bits == 0 {
+			bits = 2048
+		}
+
+		return rsa.GenerateKey(rand.Reader, bits)
+	case keyECDSA, "":
+		curves := map[int]elliptic.Curve{0: elliptic.P256(), 256: elliptic.P256(), 384: elliptic.P384(), 521: elliptic.P521()}
+		curve, ok := curves[bits]
+
+		if !ok {
+			return nil, errors.New("invalid ECDSA key size " + strconv.Itoa(bits) + ", use 256, 384 or 521")
+		}
+
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	case keyEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, errors.New("invalid key type " + keyType + ", use rsa, ecdsa or ed25519")
+	}
+}
+
+// newCertificate creates a key and a certificate signed by the issuer, or self-signed when the issuer is nil
+func newCertificate(spec certSpec, issuer *certificate) (*certificate, error) {
+	key, err := generateKey(spec.KeyType, spec.KeyBits)
+
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if spec.NotBefore.IsZero() {
+		spec.NotBefore = time.Now().Add(-time.Hour)
+	}
+
+	if spec.NotAfter.IsZero() {
+		spec.NotAfter = spec.NotBefore.Add(365 * 24 * time.Hour)
+	}
+
+	if !spec.NotAfter.After(spec.NotBefore) {
+		return nil, errors.New("certificates must expire after they become valid")
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: spec.CommonName, Organization: []string{"Erised"}},
+		NotBefore:             spec.NotBefore,
+		NotAfter:              spec.NotAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  spec.IsCA,
+	}
+
+	if spec.IsCA {
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+
+		if _, ok := key.(*rsa.PrivateKey); ok {
+			template.KeyUsage |= x509.KeyUsageKeyEncipherment
+		}
+	}
+
+	for _, host := range spec.Hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if addr, err := mail.ParseAddress(host); err == nil && addr.Address == host {
+			template.EmailAddresses = append(template.EmailAddresses, host)
+		} else if uri, err := url.Parse(host); err == nil && uri.Scheme != "" && uri.Host != "" {
+			template.URIs = append(template.URIs, uri)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	parent, signer := template, key
+
+	if issuer != nil {
+		parent, signer = issuer.cert, issuer.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &certificate{cert: cert, key: key}, nil
+}
+
+func (c *certificate) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+func (c *certificate) keyPEM() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(c.key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// tlsCertificate returns the certificate alone, without the CAs that issued it
+func (c *certificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
@@ -21,16 +21,23 @@ func setupFlags(flg *flag.FlagSet) {
 		fmt.Println("Simple http server to test arbitrary responses (" + version + ")")
 		fmt.Println("Usage examples at https://github.com/EAddario/erised")
 		fmt.Println("\nerised [options]")
+		fmt.Println("erised cert [options]\tcreates certificates, see erised cert -h")
 		fmt.Println("\nParameters:")
 		flag.PrintDefaults()
 		fmt.Println("\nHTTP Headers:")
-		fmt.Println("X-Erised-Content-Type:\t\tSets the response Content-Type")
+		fmt.Println("X-Erised-Content-Type:\t\tSets the response Content-Type. sse streams X-Erised-Data as Server-Sent Events")
 		fmt.Println("X-Erised-Data:\t\t\tReturns the same value in the response body")
+		fmt.Println("X-Erised-Failure-Rate:\t\tPercentage of responses failing with 503, or the status after a comma e.g. 10,500")
+		fmt.Println("X-Erised-Fault:\t\t\tBreaks the connection: reset/close-after-headers/truncate/hang/malformed")
 		fmt.Println("X-Erised-Headers:\t\tReturns the value(s) in the response header(s). Values must be in a JSON array")
+		fmt.Println("X-Erised-Latency:\t\tRandom delay in ms: uniform:min,max normal:mean,stddev exponential:mean percentiles:50=100,99=800")
 		fmt.Println("X-Erised-Location:\t\tSets the response Location when 300 ≤ X-Erised-Status-Code < 310")
+		fmt.Println("X-Erised-Protocol:\t\tHTTP/1.1 resets HTTP/2 requests with HTTP_1_1_REQUIRED")
 		fmt.Println("X-Erised-Response-Delay:\tNumber of milliseconds to wait before sending response back to client")
 		fmt.Println("X-Erised-Response-File:\t\tReturns the contents of file in the response body. If present, X-Erised-Data is ignored")
 		fmt.Println("X-Erised-Status-Code:\t\tSets the HTTP Status Code")
+		fmt.Println("X-Erised-Template:\t\tRenders X-Erised-Data or X-Erised-Response-File as a Go template when true")
+		fmt.Println("X-Erised-Throughput:\t\tStreams the response body at a number of bytes per second, or as chunk/interval e.g. 512/250ms")
 		fmt.Println()
 	}
 
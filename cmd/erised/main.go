@@ -6,11 +6,13 @@ import (
 	"flag"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -19,21 +21,60 @@ import (
 const version = "v0.11.2"
 
 func main() {
+	// log.Fatal exits without running deferred calls, so fatal removes the ephemeral certificates before it
+	removeCerts := func() {}
+	fatal := func(msg string) {
+		removeCerts()
+		log.Fatal().Msg(msg)
+		os.Exit(1)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "cert" {
+		if err := runCert(os.Args[2:]); err != nil && !errors.Is(err, flag.ErrHelp) {
+			fatal("Unable to create certificate: " + err.Error())
+		}
+
+		return
+	}
+
 	defer elapsedTime(time.Now(), "Erised Server")
 	log.Debug().Msg("entering main")
 
 	var dir string
 	var err error
-	certFile := flag.String("cert", "", "path to a valid X.509 certificate file")
+	certFile := flag.String("cert", "", "path to a valid X.509 certificate file. Comma separated paths serve a certificate per host name")
+	certWatch := flag.Int("cert-watch", 5, "interval in seconds to check the certificate and key files for changes. 0 disables reloading, except on SIGHUP")
+	clientAuth := flag.String("client-auth", "none", "one of none/request/require/verify. Client certificates policy when using HTTPS")
+	clientCA := flag.String("client-ca", "", "path to the PEM encoded CA certificates trusted to issue client certificates")
+	graphQLData := flag.String("graphql-data", "", "path to a JSON file with field values keyed by Type.field, used with -graphql")
+	graphQLFile := flag.String("graphql", "", "path to a GraphQL SDL schema. Queries to /graphql return data of the right shape")
+	grpcFiles := flag.String("grpc", "", "comma separated paths to .proto files or FileDescriptorSets to serve over gRPC")
+	grpcPort := flag.Int("grpc-port", 50051, "port to listen for gRPC requests when -grpc is set")
+	h2cEnabled := flag.Bool("h2c", false, "serve HTTP/2 over cleartext connections, with prior knowledge or through an Upgrade")
+	http1 := flag.Bool("http1", false, "serve HTTP/1.1 only, even when using HTTPS")
 	idleTimeout := flag.Int("idle", 120, "maximum time in seconds to wait for the next request when keep-alive is enabled")
+	journalBody := flag.Int("journal-body", journalBodyLimit, "maximum number of bytes of each request body kept in the request journal")
+	journalSize := flag.Int("journal", 1000, "maximum number of requests to keep in the request journal. 0 disables the journal")
 	jsonLog := flag.Bool("json", false, "use JSON log format")
-	keyFile := flag.String("key", "", "path to a valid private key file")
+	keyFile := flag.String("key", "", "path to a valid private key file. Comma separated paths match the -cert files")
 	logLevel := flag.String("level", "info", "one of debug/info/warn/error/off")
+	mocksFile := flag.String("mocks", "", "comma separated paths to YAML or JSON files with mock definitions")
+	openAPIFile := flag.String("openapi", "", "path to an OpenAPI 3 spec. Its operations return their documented examples")
+	outages := flag.String("outages", "", "comma separated outages, e.g. 30s-90s or flap:10s, scheduled from startup. See /erised/outages")
 	port := flag.Int("port", 0, "port to listen. Default is 8080 for HTTP and 8443 for HTTPS")
 	profile := flag.String("profile", "", "profile this session. A valid file name is required")
+	proxy := flag.String("proxy", "", "upstream URL to forward unmatched requests to. Responses are recorded under -path")
 	readTimeout := flag.Int("read", 5, "maximum duration in seconds for reading the entire request")
+	replay := flag.Bool("replay", false, "serve the responses previously recorded under -path with -proxy")
 	searchPath := flag.String("path", "", "path to search recursively for X-Erised-Response-File")
-	useTLS := flag.Bool("https", false, "use HTTPS instead of HTTP. A valid X.509 certificate and private key are required")
+	seed := flag.Int64("seed", 0, "seed for random latencies and failures, so runs can be reproduced. 0 picks a random seed")
+	tlsFaults := flag.Bool("tls-faults", false, "open extra HTTPS ports, each one serving a known-bad TLS setup. See /erised/tls/faults")
+	tlsFaultsPort := flag.Int("tls-faults-port", 8444, "first port used by -tls-faults. Each fault listens on the next consecutive port")
+	upstream := flag.String("upstream", "", "URL of a real service to forward every request to, degraded by the toxics set at /erised/toxics")
+	useAutoCert := flag.Bool("auto-cert", false, "generate an ephemeral localhost certificate when using HTTPS without -cert and -key")
+	useHTTP3 := flag.Bool("http3", false, "also serve HTTP/3 over QUIC, on the same UDP port, when using HTTPS")
+	useTLS := flag.Bool("https", false, "use HTTPS instead of HTTP. Requires -cert and -key, or -auto-cert")
+	validation := flag.String("validation", "strict", "one of strict/lenient/off. Validates requests against the -openapi spec")
 	writeTimeout := flag.Int("write", 10, "maximum duration in seconds before timing out response writes")
 	setupFlags(flag.CommandLine)
 	flag.Parse()
@@ -45,17 +86,13 @@ func main() {
 	}
 
 	if dir, err = os.Getwd(); err != nil {
-		log.Fatal().Msg("Unable to get current directory. Program will terminate.")
-		log.Fatal().Msg(err.Error())
-		os.Exit(1)
+		fatal("Unable to get current directory. Program will terminate: " + err.Error())
 	}
 
 	if *profile != "" {
 		if f, err := os.Create(*profile + ".prof"); err == nil {
 			if err = pprof.StartCPUProfile(f); err != nil {
-				log.Fatal().Msg("Cannot enable profiling. Program will terminate.")
-				log.Fatal().Msg(err.Error())
-				os.Exit(1)
+				fatal("Cannot enable profiling. Program will terminate: " + err.Error())
 			} else {
 				defer pprof.StopCPUProfile()
 			}
@@ -88,35 +125,189 @@ func main() {
 		*searchPath = filepath.Join(dir, *searchPath)
 	}
 
+	if *useAutoCert && !*useTLS {
+		fatal("Automatic certificates require HTTPS")
+	}
+
+	if *useTLS && *useAutoCert && *certFile == "" && *keyFile == "" {
+		certDir, err := os.MkdirTemp("", "erised-")
+
+		if err != nil {
+			fatal("Unable to create certificates directory: " + err.Error())
+		}
+
+		removeCerts = func() { _ = os.RemoveAll(certDir) }
+		defer removeCerts()
+		var caFile string
+
+		if *certFile, *keyFile, caFile, err = autoCert(certDir); err != nil {
+			fatal("Unable to generate certificate: " + err.Error())
+		}
+
+		log.Info().Str("cert", *certFile).Str("key", *keyFile).Str("ca", caFile).Msg("Ephemeral certificate generated")
+	}
+
 	if *useTLS && (*certFile == "" || *keyFile == "") {
-		log.Fatal().Msg("HTTPS requires a valid certificate and key file")
-		os.Exit(1)
+		fatal("HTTPS requires a valid certificate and key file, or -auto-cert")
+	}
+
+	if (*clientCA != "" || strings.ToLower(*clientAuth) != "none") && !*useTLS {
+		fatal("Client authentication requires HTTPS")
+	}
+
+	if *useHTTP3 && (!*useTLS || *http1) {
+		fatal("HTTP/3 requires HTTPS and cannot be used with -http1")
+	}
+
+	if *replay && *searchPath == "" {
+		fatal("Replay mode requires the -path option")
+	}
+
+	srv := newServer(*port, *readTimeout, *writeTimeout, *idleTimeout, *journalSize, *searchPath)
+	srv.rnd = newRandom(*seed)
+
+	if srv.jnl != nil {
+		srv.jnl.bodyLimit = *journalBody
+	}
+
+	if err = srv.setupProtocols(*h2cEnabled, *http1); err != nil {
+		fatal("Unable to set up protocols: " + err.Error())
+	}
+
+	if *useTLS {
+		if err = srv.setupCertificates(*certFile, *keyFile); err != nil {
+			fatal("Unable to load certificate: " + err.Error())
+		}
+
+		if *certWatch > 0 {
+			go srv.watchCertificates(time.Duration(*certWatch) * time.Second)
+		}
+
+		if err = srv.setupClientAuth(*clientCA, strings.ToLower(*clientAuth)); err != nil {
+			fatal("Unable to set up client authentication: " + err.Error())
+		}
+	}
+
+	if *useHTTP3 {
+		if err = srv.setupHTTP3(); err != nil {
+			fatal("Unable to set up HTTP/3: " + err.Error())
+		}
+	}
+
+	if *mocksFile != "" {
+		for _, file := range strings.Split(*mocksFile, ",") {
+			if err = srv.loadMocks(strings.TrimSpace(file)); err != nil {
+				fatal("Unable to load mocks file: " + err.Error())
+			}
+		}
 	}
 
-	srv := newServer(*port, *readTimeout, *writeTimeout, *idleTimeout, *searchPath)
+	if *openAPIFile != "" {
+		if err = srv.loadOpenAPI(*openAPIFile, strings.ToLower(*validation)); err != nil {
+			fatal("Unable to load OpenAPI spec: " + err.Error())
+		}
+	}
+
+	if *graphQLFile != "" {
+		if err = srv.loadGraphQL(*graphQLFile, *graphQLData); err != nil {
+			fatal("Unable to load GraphQL schema: " + err.Error())
+		}
+	}
+
+	if *replay {
+		if err = srv.loadMocks(filepath.Join(*searchPath, recordingsFile)); err != nil {
+			fatal("Unable to load recordings: " + err.Error())
+		}
+	}
+
+	if *proxy != "" {
+		if err = srv.setupProxy(*proxy); err != nil {
+			fatal("Unable to enable proxy mode: " + err.Error())
+		}
+	}
+
+	if *outages != "" {
+		if err = srv.loadOutages(*outages); err != nil {
+			fatal("Unable to schedule outages: " + err.Error())
+		}
+	}
+
+	if *upstream != "" {
+		if *proxy != "" {
+			fatal("The -upstream and -proxy options can't be used together")
+		}
+
+		if err = srv.setupUpstream(*upstream); err != nil {
+			fatal("Unable to enable upstream mode: " + err.Error())
+		}
+	}
+
+	if *grpcFiles != "" {
+		if err = srv.loadGRPC(*grpcFiles); err != nil {
+			fatal("Unable to load gRPC descriptors: " + err.Error())
+		}
+
+		lis, err := net.Listen("tcp", ":"+strconv.Itoa(*grpcPort))
+
+		if err != nil {
+			fatal("Unable to listen for gRPC requests: " + err.Error())
+		}
+
+		log.Info().Int("port", *grpcPort).Msg("gRPC server running")
+
+		go func() {
+			if err := srv.grp.server.Serve(lis); err != nil {
+				log.Error().Msg("gRPC server shutdown error: " + err.Error())
+			}
+		}()
+	}
+
+	if *tlsFaults {
+		if err = srv.startTLSFaults(*tlsFaultsPort); err != nil {
+			fatal("Unable to start TLS fault servers: " + err.Error())
+		}
+	}
 
 	go func() {
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
-		<-sigChan
-		srv.stp()
+
+		// with HTTPS, SIGHUP reloads the certificate instead of shutting down
+		for sig := range sigChan {
+			if sig == syscall.SIGHUP && len(srv.crt) > 0 {
+				log.Info().Msg("SIGHUP received, reloading certificate")
+				srv.reloadCertificates(true)
+				continue
+			}
+
+			srv.stp()
+			return
+		}
 	}()
 
+	if srv.h3 != nil {
+		log.Info().Int("port", *port).Msg("HTTP/3 server running")
+
+		go func() {
+			if err := srv.h3.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error().Msg("HTTP/3 server shutdown error: " + err.Error())
+			}
+		}()
+	}
+
 	go func() {
 		if *useTLS {
-			if err = srv.cfg.ListenAndServeTLS(*certFile, *keyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			if err = srv.cfg.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
 				log.Error().Msg("Server shutdown error: " + err.Error())
 				if err = syscall.Kill(syscall.Getpid(), syscall.SIGINT); err != nil {
-					log.Fatal().Msg(err.Error())
-					os.Exit(1)
+					fatal(err.Error())
 				}
 			}
 		} else {
 			if err = srv.cfg.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 				log.Error().Msg("Server shutdown error: " + err.Error())
 				if err = syscall.Kill(syscall.Getpid(), syscall.SIGINT); err != nil {
-					log.Fatal().Msg(err.Error())
-					os.Exit(1)
+					fatal(err.Error())
 				}
 			}
 		}
@@ -124,9 +315,18 @@ func main() {
 
 	select {
 	case <-srv.ctx.Done():
+		if srv.grp != nil {
+			srv.grp.server.Stop()
+		}
+
+		if srv.h3 != nil {
+			_ = srv.h3.Close()
+		}
+
+		srv.stopTLSFaults()
+
 		if err = srv.cfg.Shutdown(srv.ctx); err != nil && !errors.Is(err, context.Canceled) {
-			log.Fatal().Msg("Context shutdown error: " + err.Error())
-			os.Exit(1)
+			fatal("Context shutdown error: " + err.Error())
 		}
 	}
 
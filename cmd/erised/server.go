@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"net/http"
+	"net/http/httputil"
 	"strconv"
 	"time"
 
+	"github.com/quic-go/quic-go/http3"
 	"github.com/rs/zerolog/log"
 )
 
@@ -15,16 +17,29 @@ type server struct {
 	ctx context.Context
 	stp context.CancelFunc
 	pth string
+	mck *mockStore
+	jnl *journal
+	prx *httputil.ReverseProxy
+	rec *recorder
+	oas *openAPIMock
+	grp *grpcMock
+	gql *graphQLMock
+	h3  *http3.Server
+	flt *tlsFaults
+	crt certReloaders
+	rnd *random
+	tox *toxicProxy
+	out *outageStore
 }
 
-func newServer(port, read, write, idle int, path string) *server {
+func newServer(port, read, write, idle, journal int, path string) *server {
 	log.Debug().Msg("entering newServer")
 	srv := &server{}
 	srv.mux = &http.ServeMux{}
 
 	srv.cfg = &http.Server{
 		Addr:         ":" + strconv.Itoa(port),
-		Handler:      srv.mux,
+		Handler:      srv.handleProtocol(srv.handleJournal(srv.mux)),
 		ReadTimeout:  time.Duration(read) * time.Second,
 		WriteTimeout: time.Duration(write) * time.Second,
 		IdleTimeout:  time.Duration(idle) * time.Second,
@@ -32,6 +47,9 @@ func newServer(port, read, write, idle int, path string) *server {
 
 	srv.ctx, srv.stp = context.WithCancel(context.Background())
 	srv.pth = path
+	srv.mck = &mockStore{}
+	srv.out = &outageStore{}
+	srv.jnl = newJournal(journal)
 	srv.routes()
 	log.Info().
 		Str("version", version).
@@ -39,6 +57,7 @@ func newServer(port, read, write, idle int, path string) *server {
 		Str("readTimeout", srv.cfg.ReadTimeout.String()).
 		Str("writeTimeout", srv.cfg.WriteTimeout.String()).
 		Str("idleTimeout", srv.cfg.IdleTimeout.String()).
+		Int("journalSize", journal).
 		Str("responseFileSearchPath", path).
 		Msg("erised server running")
 	log.Debug().Msg("leaving newServer")
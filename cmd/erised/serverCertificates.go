@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// certReloader serves a certificate and key pair, reloading it when the files change
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	pair     *tls.Certificate
+	modTime  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+// reload reads the pair again. On errors, e.g. when only one of the files has been rotated yet,
+// the previous pair is kept
+func (cr *certReloader) reload() error {
+	modTime, err := cr.lastModified()
+
+	if err != nil {
+		return err
+	}
+
+	pair, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+
+	if err != nil {
+		return err
+	}
+
+	if pair.Leaf == nil {
+		if pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return err
+		}
+	}
+
+	cr.mu.Lock()
+	cr.pair, cr.modTime = &pair, modTime
+	cr.mu.Unlock()
+	log.Info().Str("cert", cr.certFile).Str("key", cr.keyFile).Time("notAfter", pair.Leaf.NotAfter).Strs("hosts", pair.Leaf.DNSNames).Msg("Certificate loaded")
+	return nil
+}
+
+func (cr *certReloader) lastModified() (time.Time, error) {
+	var modTime time.Time
+
+	for _, file := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(file)
+
+		if err != nil {
+			return modTime, err
+		}
+
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	return modTime, nil
+}
+
+// changed tells whether the files have been modified since the pair was last loaded
+func (cr *certReloader) changed() bool {
+	modTime, err := cr.lastModified()
+
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return err == nil && !modTime.Equal(cr.modTime)
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.pair, nil
+}
+
+// certReloaders holds the certificates served by HTTPS, chosen by the SNI server name
+type certReloaders []*certReloader
+
+// getCertificate returns the first certificate valid for the server name requested by the client and
+// supported by it, or the first certificate when none is or the client didn't send a server name
+func (crs certReloaders) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName != "" && len(crs) > 1 {
+		for _, cr := range crs {
+			pair, _ := cr.getCertificate(hello)
+
+			if hello.SupportsCertificate(pair) == nil {
+				return pair, nil
+			}
+		}
+	}
+
+	return crs[0].getCertificate(hello)
+}
+
+// setupCertificates serves the certificates through a callback, so they can be replaced without restarting.
+// certFiles and keyFiles are comma separated lists of matching certificate and key files
+func (srv *server) setupCertificates(certFiles, keyFiles string) error {
+	log.Debug().Msg("entering setupCertificates")
+
+	if certFiles == "" || keyFiles == "" {
+		return errors.New("a certificate and a key file are required")
+	}
+
+	certs, keys := strings.Split(certFiles, ","), strings.Split(keyFiles, ",")
+
+	if len(certs) != len(keys) {
+		return errors.New("the number of certificate and key files must match")
+	}
+
+	crs := certReloaders{}
+
+	for i := range certs {
+		cr, err := newCertReloader(strings.TrimSpace(certs[i]), strings.TrimSpace(keys[i]))
+
+		if err != nil {
+			return err
+		}
+
+		crs = append(crs, cr)
+	}
+
+	if srv.cfg.TLSConfig == nil {
+		srv.cfg.TLSConfig = &tls.Config{}
+	}
+
+	srv.crt = crs
+	srv.cfg.TLSConfig.GetCertificate = crs.getCertificate
+	log.Debug().Msg("leaving setupCertificates")
+	return nil
+}
+
+// reloadCertificates reloads the certificates whose files changed, or all of them when forced
+func (srv *server) reloadCertificates(force bool) {
+	for _, cr := range srv.crt {
+		if !force && !cr.changed() {
+			continue
+		}
+
+		if err := cr.reload(); err != nil {
+			log.Error().Str("cert", cr.certFile).Msg("Unable to reload certificate, keeping the current one: " + err.Error())
+		}
+	}
+}
+
+// watchCertificates checks the certificate files for changes every interval, until the server stops
+func (srv *server) watchCertificates(interval time.Duration) {
+	log.Debug().Msg("entering watchCertificates")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-srv.ctx.Done():
+			log.Debug().Msg("leaving watchCertificates")
+			return
+		case <-ticker.C:
+			srv.reloadCertificates(false)
+		}
+	}
+}
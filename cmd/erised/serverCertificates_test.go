@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+)
+
+func TestErisedCertificates(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "erised.crt"), filepath.Join(dir, "erised.key")
+
+	// rotate writes a new certificate, with a modification time in the future so the change is always noticed
+	rotate := func(cn string, age time.Duration) {
+		crt, err := newCertificate(certSpec{CommonName: cn, Hosts: localHosts}, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(crt.write(certFile, keyFile)).Should(Succeed())
+		Ω(os.Chtimes(certFile, time.Now().Add(age), time.Now().Add(age))).Should(Succeed())
+	}
+	served := func(ts *httptest.Server) string {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"}}}
+		res, err := client.Get(ts.URL)
+		Ω(err).ShouldNot(HaveOccurred())
+		_ = res.Body.Close()
+		return res.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	start := func() (*server, *httptest.Server) {
+		svr := &server{cfg: &http.Server{}}
+		svr.ctx, svr.stp = context.WithCancel(context.Background())
+		Ω(svr.setupCertificates(certFile, keyFile)).Should(Succeed())
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		ts.TLS = svr.cfg.TLSConfig
+		ts.StartTLS()
+		return svr, ts
+	}
+
+	g.Describe("Test certificate reloading", func() {
+		g.It("Should reject missing certificates", func() {
+			svr := &server{cfg: &http.Server{}}
+
+			Ω(svr.setupCertificates("", "")).ShouldNot(Succeed())
+			Ω(svr.setupCertificates(filepath.Join(dir, "missing.crt"), keyFile)).ShouldNot(Succeed())
+			Ω(svr.setupCertificates("certs/erised.crt", "certs/localCA.key")).ShouldNot(Succeed())
+		})
+
+		g.It("Should reload the certificate when the files change", func() {
+			rotate("first", 0)
+			svr, ts := start()
+			defer ts.Close()
+			defer svr.stp()
+
+			Ω(served(ts)).Should(Equal("first"))
+			svr.reloadCertificates(false)
+			Ω(served(ts)).Should(Equal("first"))
+
+			rotate("second", time.Minute)
+			svr.reloadCertificates(false)
+			Ω(served(ts)).Should(Equal("second"))
+		})
+
+		g.It("Should reload the certificate when forced", func() {
+			rotate("first", 0)
+			svr, ts := start()
+			defer ts.Close()
+			defer svr.stp()
+
+			// replace the files without changing their modification time
+			modTime := svr.crt[0].modTime
+			crt, _ := newCertificate(certSpec{CommonName: "unchanged", Hosts: localHosts}, nil)
+			Ω(crt.write(certFile, keyFile)).Should(Succeed())
+			Ω(os.Chtimes(certFile, modTime, modTime)).Should(Succeed())
+			Ω(os.Chtimes(keyFile, modTime, modTime)).Should(Succeed())
+
+			svr.reloadCertificates(false)
+			Ω(served(ts)).Should(Equal("first"))
+			svr.reloadCertificates(true)
+			Ω(served(ts)).Should(Equal("unchanged"))
+		})
+
+		g.It("Should keep the current certificate when the new one is invalid", func() {
+			rotate("first", 0)
+			svr, ts := start()
+			defer ts.Close()
+			defer svr.stp()
+
+			Ω(os.WriteFile(keyFile, []byte("not a key"), 0600)).Should(Succeed())
+			svr.reloadCertificates(true)
+			Ω(served(ts)).Should(Equal("first"))
+		})
+
+		g.It("Should pick the certificate by server name", func() {
+			for _, name := range []string{"payments", "identity"} {
+				crt, _ := newCertificate(certSpec{CommonName: name, Hosts: []string{name + ".test", "*." + name + ".test"}}, nil)
+				Ω(crt.write(filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key"))).Should(Succeed())
+			}
+
+			svr := &server{cfg: &http.Server{}}
+			Ω(svr.setupCertificates(filepath.Join(dir, "payments.crt")+","+filepath.Join(dir, "identity.crt"),
+				filepath.Join(dir, "payments.key"))).ShouldNot(Succeed())
+			Ω(svr.setupCertificates(filepath.Join(dir, "payments.crt")+", "+filepath.Join(dir, "identity.crt"),
+				filepath.Join(dir, "payments.key")+", "+filepath.Join(dir, "identity.key"))).Should(Succeed())
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+			ts.TLS = svr.cfg.TLSConfig
+			ts.StartTLS()
+			defer ts.Close()
+			served := func(serverName string) string {
+				client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: serverName}}}
+				res, err := client.Get(ts.URL)
+				Ω(err).ShouldNot(HaveOccurred())
+				_ = res.Body.Close()
+				return res.TLS.PeerCertificates[0].Subject.CommonName
+			}
+
+			Ω(served("identity.test")).Should(Equal("identity"))
+			Ω(served("api.identity.test")).Should(Equal("identity"))
+			Ω(served("payments.test")).Should(Equal("payments"))
+			Ω(served("storage.test")).Should(Equal("payments"))
+		})
+
+		g.It("Should watch the files for changes", func() {
+			rotate("first", 0)
+			svr, ts := start()
+			defer ts.Close()
+			defer svr.stp()
+			go svr.watchCertificates(10 * time.Millisecond)
+
+			rotate("watched", time.Minute)
+			Eventually(func() string { return served(ts) }).Should(Equal("watched"))
+		})
+	})
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	latencyUniform     = "uniform"
+	latencyNormal      = "normal"
+	latencyExponential = "exponential"
+	latencyPercentiles = "percentiles"
+)
+
+// random is a source of random numbers safe for concurrent use. The same seed draws the same numbers
+// for the same sequence of requests
+type random struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// percentile is a point of a latency table, in milliseconds
+type percentile struct {
+	rank  float64
+	value float64
+}
+
+// latency draws response delays, in milliseconds, from a distribution
+type latency struct {
+	kind   string
+	params []float64
+	table  []percentile
+}
+
+// failureRate fails the given percentage of responses with status
+type failureRate struct {
+	percent float64
+	status  int
+}
+
+// newRandom seeds a random source. 0 picks a seed, which is logged so the run can be reproduced
+func newRandom(seed int64) *random {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	log.Info().Int64("seed", seed).Msg("Random seed")
+	return &random{rnd: rand.New(rand.NewSource(seed))}
+}
+
+// float64 returns a number in [0.0,1.0). Servers without a seeded source use the global one
+func (r *random) float64() float64 {
+	if r == nil {
+		return rand.Float64()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rnd.Float64()
+}
+
+func (r *random) normFloat64() float64 {
+	if r == nil {
+		return rand.NormFloat64()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rnd.NormFloat64()
+}
+
+func (r *random) expFloat64() float64 {
+	if r == nil {
+		return rand.ExpFloat64()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rnd.ExpFloat64()
+}
+
+// parseLatency accepts uniform:min,max, normal:mean,stddev, exponential:mean or
+// percentiles:rank=value,... with every value in milliseconds
+func parseLatency(value string) (*latency, error) {
+	kind, args, _ := strings.Cut(strings.TrimSpace(value), ":")
+	lat := &latency{kind: strings.ToLower(strings.TrimSpace(kind))}
+
+	if lat.kind == latencyPercentiles {
+		return lat, lat.parseTable(args)
+	}
+
+	for _, arg := range strings.Split(args, ",") {
+		n, err := strconv.ParseFloat(strings.TrimSpace(arg), 64)
+
+		if err != nil || n < 0 || math.IsInf(n, 0) || math.IsNaN(n) {
+			return nil, errors.New("invalid latency " + value)
+		}
+
+		lat.params = append(lat.params, n)
+	}
+
+	switch {
+	case lat.kind == latencyUniform && len(lat.params) == 2 && lat.params[0] <= lat.params[1]:
+	case lat.kind == latencyNormal && len(lat.params) == 2:
+	case lat.kind == latencyExponential && len(lat.params) == 1:
+	default:
+		return nil, errors.New("invalid latency " + value + ", use uniform:min,max, normal:mean,stddev, exponential:mean or percentiles:rank=value,...")
+	}
+
+	return lat, nil
+}
+
+// parseTable reads a list of rank=value pairs, e.g. 50=100,99=800. Values can't decrease as ranks grow
+func (lat *latency) parseTable(args string) error {
+	for _, arg := range strings.Split(args, ",") {
+		rank, value, found := strings.Cut(arg, "=")
+		r, err := strconv.ParseFloat(strings.TrimPrefix(strings.ToLower(strings.TrimSpace(rank)), "p"), 64)
+
+		if err != nil || !found || r < 0 || r > 100 || math.IsNaN(r) {
+			return errors.New("invalid percentile " + arg)
+		}
+
+		v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+
+		if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+			return errors.New("invalid percentile value " + arg)
+		}
+
+		lat.table = append(lat.table, percentile{rank: r, value: v})
+	}
+
+	sort.Slice(lat.table, func(i, j int) bool { return lat.table[i].rank < lat.table[j].rank })
+
+	for i := 1; i < len(lat.table); i++ {
+		if lat.table[i].rank == lat.table[i-1].rank || lat.table[i].value < lat.table[i-1].value {
+			return errors.New("percentiles must have distinct ranks and increasing values")
+		}
+	}
+
+	return nil
+}
+
+// sample draws a delay. Negative draws of the normal distribution are returned as 0
+func (lat *latency) sample(rnd *random) time.Duration {
+	ms := 0.0
+
+	switch lat.kind {
+	case latencyUniform:
+		ms = lat.params[0] + rnd.float64()*(lat.params[1]-lat.params[0])
+	case latencyNormal:
+		ms = lat.params[0] + rnd.normFloat64()*lat.params[1]
+	case latencyExponential:
+		ms = rnd.expFloat64() * lat.params[0]
+	case latencyPercentiles:
+		ms = lat.interpolate(rnd.float64() * 100)
+	}
+
+	return time.Duration(max(ms, 0) * float64(time.Millisecond))
+}
+
+// interpolate finds the value at rank, linearly between the points of the table. The table starts at 0ms
+// unless the 0th percentile is given, and ends at the value of its highest rank
+func (lat *latency) interpolate(rank float64) float64 {
+	prev := percentile{}
+
+	for _, p := range lat.table {
+		if rank <= p.rank {
+			if p.rank == prev.rank {
+				return p.value
+			}
+
+			return prev.value + (rank-prev.rank)/(p.rank-prev.rank)*(p.value-prev.value)
+		}
+
+		prev = p
+	}
+
+	return prev.value
+}
+
+// parseFailureRate accepts a percentage of failed responses, optionally followed by their status,
+// e.g. 10 or 2.5%,500. Failures return 503 by default
+func parseFailureRate(value string) (*failureRate, error) {
+	percent, status, found := strings.Cut(strings.TrimSpace(value), ",")
+	p, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(percent), "%"), 64)
+
+	if err != nil || p < 0 || p > 100 || math.IsNaN(p) {
+		return nil, errors.New("invalid failure rate " + value + ", use a percentage between 0 and 100")
+	}
+
+	fr := &failureRate{percent: p, status: http.StatusServiceUnavailable}
+
+	if found {
+		status = strings.TrimSpace(status)
+
+		if fr.status, err = strconv.Atoi(status); err != nil {
+			fr.status = httpStatusCode(status)
+		}
+
+		if fr.status < 400 || fr.status > 599 {
+			return nil, errors.New("invalid failure status " + status)
+		}
+	}
+
+	return fr, nil
+}
+
+func (fr *failureRate) fails(rnd *random) bool {
+	return fr.percent > 0 && rnd.float64()*100 < fr.percent
+}
+
+// handleChaos delays responses by a random latency and fails some of them, as requested by
+// X-Erised-Latency and X-Erised-Failure-Rate
+func (srv *server) handleChaos(next http.HandlerFunc) http.HandlerFunc {
+	log.Debug().Msg("entering handleChaos")
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		xLatency, xFailureRate := req.Header.Get("X-Erised-Latency"), req.Header.Get("X-Erised-Failure-Rate")
+
+		if xLatency == "" && xFailureRate == "" {
+			next(res, req)
+			return
+		}
+
+		delay, fr, err := srv.chaos(xLatency, xFailureRate)
+
+		if err != nil {
+			log.Error().Msg(err.Error())
+			http.Error(res, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if delay > 0 {
+			log.Warn().Str("latency", delay.String()).Msg("pausing execution")
+
+			if !srv.pause(req, delay) {
+				return
+			}
+		}
+
+		if fr != nil && fr.fails(srv.rnd) {
+			log.Warn().Str("path", req.RequestURI).Int("status", fr.status).Msg("Failing response")
+			http.Error(res, http.StatusText(fr.status), fr.status)
+			return
+		}
+
+		next(res, req)
+	}
+}
+
+// chaos parses the latency and failure rate, drawing a delay. Either of them can be empty
+func (srv *server) chaos(lat, rate string) (time.Duration, *failureRate, error) {
+	var delay time.Duration
+	var fr *failureRate
+
+	if lat != "" {
+		l, err := parseLatency(lat)
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		delay = l.sample(srv.rnd)
+	}
+
+	if rate != "" {
+		var err error
+
+		if fr, err = parseFailureRate(rate); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return delay, fr, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+)
+
+func TestErisedChaos(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	svr := &server{mck: &mockStore{}, rnd: newRandom(42)}
+	ts := httptest.NewServer(svr.handleChaos(svr.handleMocks(svr.handleLanding())))
+	defer ts.Close()
+
+	get := func(path string, headers map[string]string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, _ = io.Copy(io.Discard, res.Body)
+		_ = res.Body.Close()
+		return res
+	}
+
+	g.Describe("Test latency distributions", func() {
+		g.It("Should parse the distributions", func() {
+			for _, value := range []string{"uniform:10,20", "normal:100, 25", "Exponential:50", "percentiles:50=10,p90=20,99=100"} {
+				_, err := parseLatency(value)
+				Ω(err).ShouldNot(HaveOccurred(), value)
+			}
+
+			for _, value := range []string{"", "100", "uniform:20,10", "uniform:10", "normal:100", "exponential:-1", "gamma:1,2",
+				"percentiles:", "percentiles:50=100,90=20", "percentiles:150=10", "percentiles:50", "normal:NaN,10", "exponential:nan",
+				"percentiles:NaN=10", "percentiles:50=NaN"} {
+				_, err := parseLatency(value)
+				Ω(err).Should(HaveOccurred(), value)
+			}
+		})
+
+		g.It("Should draw delays within the distribution", func() {
+			lat, _ := parseLatency("uniform:10,20")
+
+			for range 100 {
+				Ω(lat.sample(svr.rnd)).Should(BeNumerically("~", 15*time.Millisecond, 5*time.Millisecond))
+			}
+
+			lat, _ = parseLatency("normal:10,100")
+
+			for range 100 {
+				Ω(lat.sample(svr.rnd)).Should(BeNumerically(">=", 0))
+			}
+		})
+
+		g.It("Should interpolate percentiles", func() {
+			lat, _ := parseLatency("percentiles:50=100,90=500,99=1000")
+
+			Ω(lat.interpolate(25)).Should(Equal(50.0))
+			Ω(lat.interpolate(50)).Should(Equal(100.0))
+			Ω(lat.interpolate(70)).Should(Equal(300.0))
+			Ω(lat.interpolate(99.5)).Should(Equal(1000.0))
+
+			lat, _ = parseLatency("percentiles:0=40,100=80")
+			Ω(lat.interpolate(0)).Should(Equal(40.0))
+			Ω(lat.interpolate(50)).Should(Equal(60.0))
+		})
+
+		g.It("Should draw the same delays with the same seed", func() {
+			lat, _ := parseLatency("exponential:100")
+			first, second := newRandom(7), newRandom(7)
+
+			for range 10 {
+				Ω(lat.sample(first)).Should(Equal(lat.sample(second)))
+			}
+		})
+
+		g.It("Should delay responses", func() {
+			start := time.Now()
+			res := get("/", map[string]string{"X-Erised-Latency": "uniform:100,150"})
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(time.Since(start)).Should(BeNumerically(">=", 100*time.Millisecond))
+			Ω(get("/", map[string]string{"X-Erised-Latency": "sometimes"})).Should(HaveHTTPStatus(http.StatusBadRequest))
+		})
+	})
+
+	g.Describe("Test failure rates", func() {
+		g.It("Should parse failure rates", func() {
+			fr, err := parseFailureRate("10")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(fr.percent).Should(Equal(10.0))
+			Ω(fr.status).Should(Equal(http.StatusServiceUnavailable))
+
+			fr, err = parseFailureRate("2.5%, InternalServerError")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(fr.percent).Should(Equal(2.5))
+			Ω(fr.status).Should(Equal(http.StatusInternalServerError))
+
+			for _, value := range []string{"often", "-1", "101", "NaN", "10,200", "10,Created", "10,600"} {
+				_, err = parseFailureRate(value)
+				Ω(err).Should(HaveOccurred(), value)
+			}
+		})
+
+		g.It("Should fail a share of the responses", func() {
+			failed := 0
+
+			for range 200 {
+				if get("/", map[string]string{"X-Erised-Failure-Rate": "25,502"}).StatusCode == http.StatusBadGateway {
+					failed++
+				}
+			}
+
+			Ω(failed).Should(BeNumerically("~", 50, 25))
+			Ω(get("/", map[string]string{"X-Erised-Failure-Rate": "100"})).Should(HaveHTTPStatus(http.StatusServiceUnavailable))
+			Ω(get("/", map[string]string{"X-Erised-Failure-Rate": "0"})).Should(HaveHTTPStatus(http.StatusOK))
+		})
+
+		g.It("Should fail mock responses", func() {
+			rules, err := parseMocks([]byte("- path: /unreliable\n  failureRate: 100,504\n  latency: exponential:1\n  contentType: json\n  body: {\"ok\":true}\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(svr.mck.add(rules...)).Should(Succeed())
+
+			res := get("/unreliable", nil)
+			Ω(res).Should(HaveHTTPStatus(http.StatusGatewayTimeout))
+			Ω(res).Should(HaveHTTPHeaderWithValue("Content-Type", "text/plain; charset=utf-8"))
+
+			_, err = parseMocks([]byte("- path: /\n  failureRate: often\n"))
+			Ω(err).Should(HaveOccurred())
+			_, err = parseMocks([]byte("- path: /\n  latency: slow\n"))
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	faultReset             = "reset"
+	faultCloseAfterHeaders = "close-after-headers"
+	faultTruncate          = "truncate"
+	faultHang              = "hang"
+	faultMalformed         = "malformed"
+)
+
+var connectionFaults = map[string]bool{
+	faultReset:             true,
+	faultCloseAfterHeaders: true,
+	faultTruncate:          true,
+	faultHang:              true,
+	faultMalformed:         true,
+}
+
+type faultKey struct{}
+
+// faultWriter holds the response back when a fault is requested, so it can be sent broken
+type faultWriter struct {
+	http.ResponseWriter
+	fault     string
+	status    int
+	body      bytes.Buffer
+	committed bool
+}
+
+func (fw *faultWriter) WriteHeader(status int) {
+	if fw.fault == "" {
+		fw.committed = true
+		fw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	if fw.status == 0 {
+		fw.status = status
+	}
+}
+
+func (fw *faultWriter) Write(data []byte) (int, error) {
+	if fw.fault == "" {
+		fw.committed = true
+		return fw.ResponseWriter.Write(data)
+	}
+
+	if fw.status == 0 {
+		fw.status = http.StatusOK
+	}
+
+	return fw.body.Write(data)
+}
+
+func (fw *faultWriter) Unwrap() http.ResponseWriter {
+	return fw.ResponseWriter
+}
+
+func (fw *faultWriter) Flush() {
+	if f, ok := fw.ResponseWriter.(http.Flusher); ok && fw.fault == "" {
+		fw.committed = true
+		f.Flush()
+	}
+}
+
+// setFault requests a fault for the response, unless it has already started
+func setFault(req *http.Request, fault string) {
+	if fw, ok := req.Context().Value(faultKey{}).(*faultWriter); ok && !fw.committed {
+		fw.fault = fault
+	}
+}
+
+func (srv *server) handleFaults(next http.HandlerFunc) http.HandlerFunc {
+	log.Debug().Msg("entering handleFaults")
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		xFault := strings.ToLower(req.Header.Get("X-Erised-Fault"))
+
+		if xFault != "" && !connectionFaults[xFault] {
+			log.Error().Msg("Unknown fault " + xFault)
+			http.Error(res, "Bad Request: unknown fault "+xFault, http.StatusBadRequest)
+			return
+		}
+
+		fw := &faultWriter{ResponseWriter: res, fault: xFault}
+		next(fw, req.WithContext(context.WithValue(req.Context(), faultKey{}, fw)))
+
+		if fw.fault != "" {
+			srv.injectFault(fw, req)
+		}
+	}
+}
+
+// injectFault breaks the connection as requested. HTTP/2 and HTTP/3 connections can't be hijacked,
+// so their stream is reset instead of the connection
+func (srv *server) injectFault(fw *faultWriter, req *http.Request) {
+	log.Debug().Msg("entering injectFault")
+	log.Warn().
+		Str("protocol", req.Proto).
+		Str("remoteAddress", req.RemoteAddr).
+		Str("method", req.Method).
+		Str("host", req.Host).
+		Str("path", req.RequestURI).
+		Str("fault", fw.fault).
+		Msg("injectFault")
+
+	if fw.status == 0 {
+		fw.status = http.StatusOK
+	}
+
+	entry := requestEntry(req)
+
+	if entry != nil {
+		entry.Fault = fw.fault
+
+		if fw.fault == faultCloseAfterHeaders || fw.fault == faultTruncate {
+			entry.Status = fw.status
+		}
+	}
+
+	// the declared length is never sent in full, even when the body is empty
+	body := fw.body.Bytes()
+	length := max(len(body), 1)
+	fw.Header().Set("Content-Length", strconv.Itoa(length))
+	conn, buf, err := http.NewResponseController(fw.ResponseWriter).Hijack()
+
+	if err != nil {
+		srv.abortStream(fw, req, body[:len(body)/2])
+		return
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	// deadlines set by the server for the request still apply to hijacked connections
+	_ = conn.SetDeadline(time.Time{})
+
+	switch fw.fault {
+	case faultReset:
+		resetConn(conn)
+	case faultCloseAfterHeaders, faultTruncate:
+		_, _ = buf.WriteString(req.Proto + " " + strconv.Itoa(fw.status) + " " + http.StatusText(fw.status) + "\r\n")
+		_ = fw.Header().Write(buf)
+		_, _ = buf.WriteString("\r\n")
+
+		if fw.fault == faultTruncate {
+			_, _ = buf.Write(body[:len(body)/2])
+		}
+
+		_ = buf.Flush()
+	case faultHang:
+		if srv.ctx != nil {
+			stop := context.AfterFunc(srv.ctx, func() { _ = conn.Close() })
+			defer stop()
+		}
+
+		// wait until the client gives up
+		_, _ = io.Copy(io.Discard, conn)
+	case faultMalformed:
+		_, _ = buf.WriteString("HTTP/1.1 ERISED Mirror Cracked\r\nthis is not a header\r\nContent-Length: -1\r\n\r\n")
+		_ = buf.Flush()
+	}
+
+	log.Debug().Msg("leaving injectFault")
+}
+
+// abortStream sends as much of the fault as the protocol allows before resetting the stream
+func (srv *server) abortStream(fw *faultWriter, req *http.Request, partial []byte) {
+	res := fw.ResponseWriter
+
+	switch fw.fault {
+	case faultHang:
+		if srv.ctx != nil {
+			select {
+			case <-req.Context().Done():
+			case <-srv.ctx.Done():
+			}
+		} else {
+			<-req.Context().Done()
+		}
+
+		return
+	case faultCloseAfterHeaders, faultTruncate:
+		res.WriteHeader(fw.status)
+
+		if fw.fault == faultTruncate {
+			_, _ = res.Write(partial)
+		}
+
+		_ = http.NewResponseController(res).Flush()
+	}
+
+	if hs, ok := httpStreamer(res); ok {
+		str := hs.HTTPStream()
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeInternalError))
+		str.CancelWrite(quic.StreamErrorCode(http3.ErrCodeInternalError))
+	}
+
+	panic(http.ErrAbortHandler)
+}
+
+// resetConn closes the connection with a TCP RST instead of a FIN
+func resetConn(conn net.Conn) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.SetLinger(0)
+	}
+
+	_ = conn.Close()
+}
+
+// httpStreamer finds the HTTP/3 stream behind wrapped response writers
+func httpStreamer(res http.ResponseWriter) (http3.HTTPStreamer, bool) {
+	for {
+		if hs, ok := res.(http3.HTTPStreamer); ok {
+			return hs, true
+		}
+
+		u, ok := res.(interface{ Unwrap() http.ResponseWriter })
+
+		if !ok {
+			return nil, false
+		}
+
+		res = u.Unwrap()
+	}
+}
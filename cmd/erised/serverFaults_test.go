@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+)
+
+func TestErisedFaults(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	svr := &server{mck: &mockStore{}, jnl: newJournal(10)}
+	svr.ctx, svr.stp = context.WithCancel(context.Background())
+	defer svr.stp()
+	handler := svr.handleJournal(svr.handleFaults(svr.handleMocks(svr.handleLanding())))
+
+	get := func(url, fault, data string) (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("X-Erised-Fault", fault)
+		req.Header.Set("X-Erised-Data", data)
+		client := &http.Client{Timeout: 500 * time.Millisecond, Transport: &http.Transport{DisableKeepAlives: true}}
+		return client.Do(req)
+	}
+
+	g.Describe("Test connection faults", func() {
+		var ts *httptest.Server
+
+		g.Before(func() {
+			ts = httptest.NewServer(handler)
+		})
+
+		g.After(func() {
+			ts.Close()
+		})
+
+		g.It("Should reset the connection before the headers", func() {
+			conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+			Ω(err).ShouldNot(HaveOccurred())
+			defer func() { _ = conn.Close() }()
+
+			_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nX-Erised-Fault: reset\r\n\r\n"))
+			_, err = conn.Read(make([]byte, 1))
+			Ω(errors.Is(err, syscall.ECONNRESET)).Should(BeTrue())
+		})
+
+		g.It("Should close the connection after the headers", func() {
+			res, err := get(ts.URL, "close-after-headers", "Hello World")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer func() { _ = res.Body.Close() }()
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(res.ContentLength).Should(BeEquivalentTo(11))
+			body, err := io.ReadAll(res.Body)
+			Ω(err).Should(MatchError(io.ErrUnexpectedEOF))
+			Ω(body).Should(BeEmpty())
+		})
+
+		g.It("Should send half of the body", func() {
+			res, err := get(ts.URL, "Truncate", "0123456789")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer func() { _ = res.Body.Close() }()
+
+			body, err := io.ReadAll(res.Body)
+			Ω(err).Should(MatchError(io.ErrUnexpectedEOF))
+			Ω(string(body)).Should(Equal("01234"))
+		})
+
+		g.It("Should hang until the client gives up", func() {
+			start := time.Now()
+			_, err := get(ts.URL, "hang", "")
+
+			Ω(err).Should(MatchError(ContainSubstring("Client.Timeout")))
+			Ω(time.Since(start)).Should(BeNumerically(">=", 500*time.Millisecond))
+		})
+
+		g.It("Should return malformed HTTP", func() {
+			_, err := get(ts.URL, "malformed", "")
+			Ω(err).Should(MatchError(ContainSubstring("malformed HTTP")))
+		})
+
+		g.It("Should return BadRequest for unknown faults", func() {
+			res, err := get(ts.URL, "meteor", "")
+			Ω(err).ShouldNot(HaveOccurred())
+			_ = res.Body.Close()
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusBadRequest))
+		})
+
+		g.It("Should record faults in the journal", func() {
+			_, _ = get(ts.URL+"/journaled", "truncate", "0123456789")
+			entries := svr.jnl.list(journalFilter{Path: "/journaled"})
+
+			Ω(entries).Should(HaveLen(1))
+			Ω(entries[0].Fault).Should(Equal("truncate"))
+			Ω(entries[0].Status).Should(Equal(http.StatusOK))
+
+			_, _ = get(ts.URL+"/journaled", "reset", "")
+			entries = svr.jnl.list(journalFilter{Path: "/journaled"})
+			Ω(entries[1].Fault).Should(Equal("reset"))
+			Ω(entries[1].Status).Should(BeZero())
+		})
+
+		g.It("Should inject faults declared by mocks", func() {
+			rules, err := parseMocks([]byte("- path: /flaky\n  responses:\n    - fault: RESET\n    - status: 201\n      body: recovered\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(svr.mck.add(rules...)).Should(Succeed())
+
+			_, err = get(ts.URL+"/flaky", "", "")
+			Ω(err).Should(HaveOccurred())
+
+			res, err := get(ts.URL+"/flaky", "", "")
+			Ω(err).ShouldNot(HaveOccurred())
+			body, _ := io.ReadAll(res.Body)
+			_ = res.Body.Close()
+			Ω(res).Should(HaveHTTPStatus(http.StatusCreated))
+			Ω(string(body)).Should(Equal("recovered"))
+
+			_, err = parseMocks([]byte("- path: /\n  fault: meteor\n"))
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	g.Describe("Test HTTP/2 faults", func() {
+		var ts *httptest.Server
+		var client *http.Client
+
+		g.Before(func() {
+			ts = httptest.NewUnstartedServer(handler)
+			ts.EnableHTTP2 = true
+			ts.StartTLS()
+			client = ts.Client()
+			client.Timeout = 500 * time.Millisecond
+		})
+
+		g.After(func() {
+			ts.Close()
+		})
+
+		do := func(fault, data string) (*http.Response, error) {
+			req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+			req.Header.Set("X-Erised-Fault", fault)
+			req.Header.Set("X-Erised-Data", data)
+			return client.Do(req)
+		}
+
+		g.It("Should reset the stream", func() {
+			_, err := do("reset", "")
+			Ω(err).Should(MatchError(ContainSubstring("INTERNAL_ERROR")))
+		})
+
+		g.It("Should reset the stream after half of the body", func() {
+			res, err := do("truncate", "0123456789")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer func() { _ = res.Body.Close() }()
+
+			Ω(res.ProtoMajor).Should(Equal(2))
+			body, err := io.ReadAll(res.Body)
+			Ω(err).Should(HaveOccurred())
+			Ω(strings.HasPrefix("01234", string(body))).Should(BeTrue())
+		})
+
+		g.It("Should hang until the client gives up", func() {
+			_, err := do("hang", "")
+			Ω(err).Should(MatchError(ContainSubstring("Client.Timeout")))
+		})
+	})
+}
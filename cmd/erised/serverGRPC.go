@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bufbuild/protocompile"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	v1reflectiongrpc "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	v1alphareflectiongrpc "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+type grpcReply struct {
+	code    codes.Code
+	message string
+	data    string
+	delay   time.Duration
+	headers metadata.MD
+}
+
+type grpcMock struct {
+	files    *protoregistry.Files
+	types    *protoregistry.Types
+	services []protoreflect.ServiceDescriptor
+	server   *grpc.Server
+}
+
+// loadGRPC builds a gRPC server for the services in a comma separated list of .proto files or
+// FileDescriptorSets. The server uses the certificates of the HTTPS server when set up, and h2c otherwise
+func (srv *server) loadGRPC(paths string) error {
+	log.Debug().Msg("entering loadGRPC")
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := map[string]bool{}
+
+	for _, path := range strings.Split(paths, ",") {
+		fds, err := descriptorFiles(strings.TrimSpace(path))
+
+		if err != nil {
+			return errors.New(path + ": " + err.Error())
+		}
+
+		for _, fd := range fds {
+			if !seen[fd.GetName()] {
+				seen[fd.GetName()] = true
+				set.File = append(set.File, fd)
+			}
+		}
+	}
+
+	files, err := protodesc.NewFiles(set)
+
+	if err != nil {
+		return err
+	}
+
+	gm := &grpcMock{files: files, types: &protoregistry.Types{}}
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		for i := 0; i < fd.Services().Len(); i++ {
+			gm.services = append(gm.services, fd.Services().Get(i))
+		}
+
+		gm.registerTypes(fd.Messages(), fd.Extensions())
+		return true
+	})
+
+	if len(gm.services) == 0 {
+		return errors.New("no services found in " + paths)
+	}
+
+	opts := []grpc.ServerOption{grpc.UnknownServiceHandler(srv.handleGRPC)}
+
+	if len(srv.crt) > 0 {
+		// the certificates and client authentication of the HTTP server are shared
+		cfg := &tls.Config{GetCertificate: srv.crt.getCertificate}
+
+		if srv.cfg.TLSConfig != nil {
+			cfg = srv.cfg.TLSConfig.Clone()
+		}
+
+		opts = append(opts, grpc.Creds(credentials.NewTLS(cfg)))
+	}
+
+	gm.server = grpc.NewServer(opts...)
+	reflectionOpts := reflection.ServerOptions{Services: gm, DescriptorResolver: files, ExtensionResolver: gm.types}
+	v1reflectiongrpc.RegisterServerReflectionServer(gm.server, reflection.NewServerV1(reflectionOpts))
+	v1alphareflectiongrpc.RegisterServerReflectionServer(gm.server, reflection.NewServer(reflectionOpts))
+	srv.grp = gm
+	log.Info().Str("files", paths).Int("services", len(gm.services)).Bool("tls", srv.crt != nil).Msg("gRPC descriptors loaded")
+	log.Debug().Msg("leaving loadGRPC")
+	return nil
+}
+
+// descriptorFiles compiles .proto files, including their imports, or reads a binary FileDescriptorSet
+func descriptorFiles(path string) ([]*descriptorpb.FileDescriptorProto, error) {
+	if filepath.Ext(path) == ".proto" {
+		compiler := protocompile.Compiler{
+			Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+				ImportPaths: []string{filepath.Dir(path), "."},
+			}),
+		}
+		compiled, err := compiler.Compile(context.Background(), filepath.Base(path))
+
+		if err != nil {
+			return nil, err
+		}
+
+		fds := make([]*descriptorpb.FileDescriptorProto, 0)
+		var add func(fd protoreflect.FileDescriptor)
+		add = func(fd protoreflect.FileDescriptor) {
+			for i := 0; i < fd.Imports().Len(); i++ {
+				add(fd.Imports().Get(i).FileDescriptor)
+			}
+
+			fds = append(fds, protodesc.ToFileDescriptorProto(fd))
+		}
+
+		for _, fd := range compiled {
+			add(fd)
+		}
+
+		return fds, nil
+	}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+
+	if err = proto.Unmarshal(data, set); err != nil {
+		return nil, errors.New("not a .proto file or a FileDescriptorSet: " + err.Error())
+	}
+
+	return set.File, nil
+}
+
+// registerTypes makes messages and extensions available to JSON Any fields and server reflection
+func (gm *grpcMock) registerTypes(msgs protoreflect.MessageDescriptors, exts protoreflect.ExtensionDescriptors) {
+	for i := 0; i < msgs.Len(); i++ {
+		_ = gm.types.RegisterMessage(dynamicpb.NewMessageType(msgs.Get(i)))
+		gm.registerTypes(msgs.Get(i).Messages(), msgs.Get(i).Extensions())
+	}
+
+	for i := 0; i < exts.Len(); i++ {
+		_ = gm.types.RegisterExtension(dynamicpb.NewExtensionType(exts.Get(i)))
+	}
+}
+
+// GetServiceInfo advertises the mocked services, alongside the registered ones, to server reflection
+func (gm *grpcMock) GetServiceInfo() map[string]grpc.ServiceInfo {
+	info := gm.server.GetServiceInfo()
+
+	for _, sd := range gm.services {
+		methods := make([]grpc.MethodInfo, 0, sd.Methods().Len())
+
+		for i := 0; i < sd.Methods().Len(); i++ {
+			md := sd.Methods().Get(i)
+			methods = append(methods, grpc.MethodInfo{
+				Name:           string(md.Name()),
+				IsClientStream: md.IsStreamingClient(),
+				IsServerStream: md.IsStreamingServer(),
+			})
+		}
+
+		info[string(sd.FullName())] = grpc.ServiceInfo{Methods: methods, Metadata: sd.ParentFile().Path()}
+	}
+
+	return info
+}
+
+// method resolves a full method name such as /package.Service/Method
+func (gm *grpcMock) method(name string) protoreflect.MethodDescriptor {
+	svc, mth, ok := strings.Cut(strings.TrimPrefix(name, "/"), "/")
+
+	if !ok {
+		return nil
+	}
+
+	desc, err := gm.files.FindDescriptorByName(protoreflect.FullName(svc))
+
+	if err != nil {
+		return nil
+	}
+
+	if sd, ok := desc.(protoreflect.ServiceDescriptor); ok {
+		return sd.Methods().ByName(protoreflect.Name(mth))
+	}
+
+	return nil
+}
+
+func (srv *server) handleGRPC(_ interface{}, stream grpc.ServerStream) error {
+	log.Debug().Msg("entering handleGRPC")
+	name, _ := grpc.MethodFromServerStream(stream)
+	meta, _ := metadata.FromIncomingContext(stream.Context())
+	remote := ""
+
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		remote = p.Addr.String()
+	}
+
+	log.Info().
+		Str("protocol", "gRPC").
+		Str("remoteAddress", remote).
+		Str("method", name).
+		Msg("handleGRPC")
+	md := srv.grp.method(name)
+
+	if md == nil {
+		return status.Error(codes.Unimplemented, "unknown method "+name)
+	}
+
+	in := dynamicpb.NewMessage(md.Input())
+
+	// client streams are read to the end, and the last message is the one matched and templated
+	for {
+		next := dynamicpb.NewMessage(md.Input())
+		err := stream.RecvMsg(next)
+
+		if md.IsStreamingClient() && errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if in = next; !md.IsStreamingClient() {
+			break
+		}
+	}
+
+	body, _ := protojson.MarshalOptions{Resolver: srv.grp.types}.Marshal(in)
+	req, _ := http.NewRequestWithContext(stream.Context(), http.MethodPost, name, bytes.NewReader(body))
+	req.Proto, req.RemoteAddr = "gRPC", remote
+
+	for k, v := range meta {
+		if !strings.HasPrefix(k, ":") {
+			req.Header[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+
+	if auth := meta.Get(":authority"); len(auth) > 0 {
+		req.Host = auth[0]
+	}
+
+	entry := &journalEntry{
+		Time:          time.Now(),
+		Protocol:      req.Proto,
+		RemoteAddress: remote,
+		Method:        req.Method,
+		Host:          req.Host,
+		Path:          name,
+		Headers:       req.Header.Clone(),
+		Body:          string(body),
+		Status:        http.StatusOK,
+	}
+
+	if srv.jnl != nil {
+		defer srv.jnl.add(entry)
+	}
+
+	rpl := srv.grpcResponse(req, entry)
+
+	if err := stream.SetHeader(rpl.headers); err != nil {
+		return err
+	}
+
+	if rpl.code != codes.OK {
+		if !srv.pause(req, rpl.delay) {
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+
+		return status.Error(rpl.code, rpl.message)
+	}
+
+	msgs, err := grpcMessages(md, rpl.data, srv.grp.types)
+
+	if err != nil {
+		log.Error().Str("method", name).Msg(err.Error())
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	for _, msg := range msgs {
+		if !srv.pause(req, rpl.delay) {
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+
+		if err = stream.SendMsg(msg); err != nil {
+			return err
+		}
+	}
+
+	log.Debug().Msg("leaving handleGRPC")
+	return nil
+}
+
+// grpcResponse returns the reply of the mock matching the request or, when none matches, the one
+// described by the x-erised-* metadata
+func (srv *server) grpcResponse(req *http.Request, entry *journalEntry) *grpcReply {
+	rpl := &grpcReply{headers: metadata.MD{}}
+
+	if rule, rsp, params := srv.mck.match(req); rule != nil {
+		log.Info().Str("method", req.URL.Path).Str("mock", rule.ID).Msg("handleGRPC")
+		entry.Mock = rule.ID
+		rpl.code = grpcCodeFromHTTP(int(rsp.Status))
+		rpl.data = string(rsp.Body)
+		rpl.delay = time.Duration(rsp.Delay) * time.Millisecond
+
+		for k, v := range rsp.Headers {
+			rpl.headers.Set(k, fmt.Sprintf("%v", v))
+		}
+
+		if rsp.BodyFile != "" {
+			if srv.pth == "" {
+				log.Error().Str("mock", rule.ID).Msg("bodyFile " + rsp.BodyFile + " requires the -path option")
+				rpl.code, rpl.message = codes.NotFound, "bodyFile "+rsp.BodyFile+" not found"
+				return rpl
+			}
+
+			ct, st := srv.responseFile(rsp.BodyFile)
+
+			if st != http.StatusOK {
+				rpl.code, rpl.message = grpcCodeFromHTTP(st), "bodyFile "+rsp.BodyFile+" not found"
+				return rpl
+			}
+
+			rpl.data = ct
+		}
+
+		if rsp.Template && rpl.data != "" {
+			out, err := render(rpl.data, req, params)
+
+			if err != nil {
+				log.Error().Str("mock", rule.ID).Msg("Unable to render template: " + err.Error())
+				rpl.code, rpl.message = codes.Internal, "unable to render template"
+				return rpl
+			}
+
+			rpl.data = out
+		}
+
+		// the body of error responses is the status message
+		if rpl.code != codes.OK {
+			rpl.message, rpl.data = rpl.data, ""
+		}
+
+		return rpl
+	}
+
+	if xrd, err := strconv.Atoi(req.Header.Get("X-Erised-Response-Delay")); xrd > 0 && err == nil {
+		rpl.delay = time.Duration(xrd) * time.Millisecond
+	}
+
+	var hdrs map[string]interface{}
+
+	if err := json.Unmarshal([]byte(req.Header.Get("X-Erised-Headers")), &hdrs); err == nil {
+		for k, v := range hdrs {
+			rpl.headers.Set(k, fmt.Sprintf("%v", v))
+		}
+	}
+
+	rpl.code = grpcCode(req.Header.Get("X-Erised-Status-Code"))
+	rpl.message = req.Header.Get("X-Erised-Status-Message")
+	rpl.data = req.Header.Get("X-Erised-Data")
+
+	if rpl.message == "" && rpl.code != codes.OK {
+		rpl.message = rpl.code.String()
+	}
+
+	return rpl
+}
+
+// grpcMessages converts a JSON message, or a JSON list of messages for server streams, to the method's output type
+func grpcMessages(md protoreflect.MethodDescriptor, data string, types *protoregistry.Types) ([]proto.Message, error) {
+	raws := []json.RawMessage{json.RawMessage("{}")}
+
+	if data = strings.TrimSpace(data); strings.HasPrefix(data, "[") {
+		if err := json.Unmarshal([]byte(data), &raws); err != nil {
+			return nil, errors.New("invalid response messages: " + err.Error())
+		}
+
+		if !md.IsStreamingServer() && len(raws) != 1 {
+			return nil, errors.New("unary methods return exactly one message")
+		}
+	} else if data != "" {
+		raws[0] = json.RawMessage(data)
+	}
+
+	msgs := make([]proto.Message, 0, len(raws))
+
+	for _, raw := range raws {
+		msg := dynamicpb.NewMessage(md.Output())
+
+		if err := (protojson.UnmarshalOptions{Resolver: types}).Unmarshal(raw, msg); err != nil {
+			return nil, errors.New("invalid response message: " + err.Error())
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+// grpcCode accepts status codes by number or by name, such as 5, NOT_FOUND or NotFound
+func grpcCode(code string) codes.Code {
+	if n, err := strconv.Atoi(code); err == nil && n >= 0 && n <= 16 {
+		return codes.Code(n)
+	}
+
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if strings.EqualFold(strings.ReplaceAll(code, "_", ""), c.String()) {
+			return c
+		}
+	}
+
+	return codes.OK
+}
+
+// grpcCodeFromHTTP maps the status of mock definitions to the closest gRPC status code
+func grpcCodeFromHTTP(status int) codes.Code {
+	switch {
+	case status < 400:
+		return codes.OK
+	case status == http.StatusBadRequest:
+		return codes.InvalidArgument
+	case status == http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case status == http.StatusForbidden:
+		return codes.PermissionDenied
+	case status == http.StatusNotFound, status == http.StatusGone:
+		return codes.NotFound
+	case status == http.StatusConflict:
+		return codes.AlreadyExists
+	case status == http.StatusPreconditionFailed:
+		return codes.FailedPrecondition
+	case status == http.StatusRequestTimeout, status == http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	case status == http.StatusTooManyRequests, status == http.StatusInsufficientStorage:
+		return codes.ResourceExhausted
+	case status == 499:
+		return codes.Canceled
+	case status == http.StatusNotImplemented, status == http.StatusMethodNotAllowed:
+		return codes.Unimplemented
+	case status == http.StatusBadGateway, status == http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case status >= 500:
+		return codes.Internal
+	default:
+		return codes.Unknown
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func TestErisedGRPC(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	svr := server{mck: &mockStore{}, jnl: newJournal(10)}
+
+	if err := svr.loadGRPC("serverGRPC_test.proto"); err != nil {
+		t.Fatal(err)
+	}
+
+	lis, _ := net.Listen("tcp", "127.0.0.1:0")
+	go func() { _ = svr.grp.server.Serve(lis) }()
+	defer svr.grp.server.Stop()
+	conn, _ := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer func() { _ = conn.Close() }()
+	getJoke := svr.grp.method("/erised.test.Jokes/GetJoke")
+	request := func(category string) *dynamicpb.Message {
+		in := dynamicpb.NewMessage(getJoke.Input())
+		in.Set(getJoke.Input().Fields().ByName("category"), protoreflect.ValueOfString(category))
+		return in
+	}
+	value := func(msg *dynamicpb.Message) string {
+		return msg.Get(getJoke.Output().Fields().ByName("value")).String()
+	}
+
+	g.Describe("Test gRPC descriptors", func() {
+		g.It("Should resolve known methods only", func() {
+			Ω(getJoke).ShouldNot(BeNil())
+			Ω(svr.grp.method("/erised.test.Jokes/Unknown")).Should(BeNil())
+			Ω(svr.grp.method("/erised.test.Joke/GetJoke")).Should(BeNil())
+		})
+
+		g.It("Should fail without services", func() {
+			Ω(svr.loadGRPC("serverMocks_test.yaml")).ShouldNot(Succeed())
+		})
+
+		g.It("Should parse status codes", func() {
+			Ω(grpcCode("5")).Should(Equal(codes.NotFound))
+			Ω(grpcCode("NOT_FOUND")).Should(Equal(codes.NotFound))
+			Ω(grpcCode("PermissionDenied")).Should(Equal(codes.PermissionDenied))
+			Ω(grpcCode("Whatever")).Should(Equal(codes.OK))
+			Ω(grpcCodeFromHTTP(http.StatusServiceUnavailable)).Should(Equal(codes.Unavailable))
+		})
+	})
+
+	g.Describe("Test gRPC calls", func() {
+		g.It("Should return an empty message by default", func() {
+			out := dynamicpb.NewMessage(getJoke.Output())
+			err := conn.Invoke(context.Background(), "/erised.test.Jokes/GetJoke", request("dev"), out)
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(value(out)).Should(BeEmpty())
+		})
+
+		g.It("Should return x-erised-data and x-erised-headers", func() {
+			ctx := metadata.AppendToOutgoingContext(context.Background(),
+				"x-erised-data", `{"id":"42","value":"Chuck Norris counted to infinity. Twice.","createdAt":"2020-01-05T13:42:19Z"}`,
+				"x-erised-headers", `{"x-joke-source":"erised"}`)
+			out := dynamicpb.NewMessage(getJoke.Output())
+			var hdr metadata.MD
+			err := conn.Invoke(ctx, "/erised.test.Jokes/GetJoke", request("dev"), out, grpc.Header(&hdr))
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(value(out)).Should(Equal("Chuck Norris counted to infinity. Twice."))
+			Ω(hdr.Get("x-joke-source")).Should(Equal([]string{"erised"}))
+		})
+
+		g.It("Should return x-erised-status-code", func() {
+			ctx := metadata.AppendToOutgoingContext(context.Background(),
+				"x-erised-status-code", "NOT_FOUND", "x-erised-status-message", "no jokes left")
+			err := conn.Invoke(ctx, "/erised.test.Jokes/GetJoke", request("dev"), dynamicpb.NewMessage(getJoke.Output()))
+
+			Ω(status.Code(err)).Should(Equal(codes.NotFound))
+			Ω(status.Convert(err).Message()).Should(Equal("no jokes left"))
+		})
+
+		g.It("Should return Internal for invalid messages", func() {
+			ctx := metadata.AppendToOutgoingContext(context.Background(), "x-erised-data", `{"punchline":"none"}`)
+			err := conn.Invoke(ctx, "/erised.test.Jokes/GetJoke", request("dev"), dynamicpb.NewMessage(getJoke.Output()))
+
+			Ω(status.Code(err)).Should(Equal(codes.Internal))
+		})
+
+		g.It("Should return Unimplemented for unknown methods", func() {
+			err := conn.Invoke(context.Background(), "/erised.test.Jokes/Unknown", request("dev"), dynamicpb.NewMessage(getJoke.Output()))
+
+			Ω(status.Code(err)).Should(Equal(codes.Unimplemented))
+		})
+
+		g.It("Should stream a list of messages", func() {
+			ctx := metadata.AppendToOutgoingContext(context.Background(), "x-erised-data", `[{"value":"one"},{"value":"two"}]`)
+			stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, "/erised.test.Jokes/ListJokes")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(stream.SendMsg(request("dev"))).Should(Succeed())
+			Ω(stream.CloseSend()).Should(Succeed())
+			values := []string{}
+
+			for {
+				out := dynamicpb.NewMessage(getJoke.Output())
+
+				if err = stream.RecvMsg(out); err != nil {
+					break
+				}
+
+				values = append(values, value(out))
+			}
+
+			Ω(err).Should(Equal(io.EOF))
+			Ω(values).Should(Equal([]string{"one", "two"}))
+		})
+
+		g.It("Should serve mock definitions keyed by method", func() {
+			rules, err := parseMocks([]byte(`[
+				{"id":"dev","path":"/erised.test.Jokes/GetJoke","match":{"jsonPath":{"$.category":"dev"}},"body":{"value":"{{ jsonPath .Request.Body ` + "`$.category`" + ` }} joke"},"template":true,"headers":{"x-mock":"dev"}},
+				{"id":"missing","path":"/erised.test.Jokes/GetJoke","status":404,"body":"no such category"}
+			]`))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(svr.mck.add(rules...)).Should(Succeed())
+			defer svr.mck.clear()
+
+			out := dynamicpb.NewMessage(getJoke.Output())
+			var hdr metadata.MD
+			err = conn.Invoke(context.Background(), "/erised.test.Jokes/GetJoke", request("dev"), out, grpc.Header(&hdr))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(value(out)).Should(Equal("dev joke"))
+			Ω(hdr.Get("x-mock")).Should(Equal([]string{"dev"}))
+
+			err = conn.Invoke(context.Background(), "/erised.test.Jokes/GetJoke", request("movie"), out)
+			Ω(status.Code(err)).Should(Equal(codes.NotFound))
+			Ω(status.Convert(err).Message()).Should(Equal("no such category"))
+		})
+
+		g.It("Should record calls in the journal", func() {
+			entries := svr.jnl.list(journalFilter{Path: "/erised.test.Jokes/GetJoke", Mock: "dev"})
+
+			Ω(entries).Should(HaveLen(1))
+			Ω(entries[0].Protocol).Should(Equal("gRPC"))
+			Ω(entries[0].Body).Should(MatchJSON(`{"category":"dev"}`))
+		})
+
+		g.It("Should advertise the mocked services through reflection", func() {
+			Ω(svr.grp.GetServiceInfo()).Should(HaveKey("erised.test.Jokes"))
+			Ω(svr.grp.GetServiceInfo()).Should(HaveKey("grpc.reflection.v1.ServerReflection"))
+		})
+
+		g.It("Should require client certificates when configured", func() {
+			tlsSvr := server{cfg: &http.Server{}, mck: &mockStore{}}
+			Ω(tlsSvr.setupCertificates("certs/erised.crt", "certs/erised.key")).Should(Succeed())
+			Ω(tlsSvr.setupClientAuth("", "require")).Should(Succeed())
+			Ω(tlsSvr.loadGRPC("serverGRPC_test.proto")).Should(Succeed())
+			tlsLis, _ := net.Listen("tcp", "127.0.0.1:0")
+			go func() { _ = tlsSvr.grp.server.Serve(tlsLis) }()
+			defer tlsSvr.grp.server.Stop()
+
+			pem, _ := os.ReadFile("certs/localCA.pem")
+			roots := x509.NewCertPool()
+			roots.AppendCertsFromPEM(pem)
+			invoke := func(certs ...tls.Certificate) error {
+				creds := credentials.NewTLS(&tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: certs})
+				tlsConn, _ := grpc.NewClient(tlsLis.Addr().String(), grpc.WithTransportCredentials(creds))
+				defer func() { _ = tlsConn.Close() }()
+				return tlsConn.Invoke(context.Background(), "/erised.test.Jokes/GetJoke", request("dev"), dynamicpb.NewMessage(getJoke.Output()))
+			}
+
+			Ω(invoke()).ShouldNot(Succeed())
+			pair, _ := tls.LoadX509KeyPair("certs/erised.crt", "certs/erised.key")
+			Ω(invoke(pair)).Should(Succeed())
+		})
+	})
+}
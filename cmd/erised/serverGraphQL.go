@@ -0,0 +1,851 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vektah/gqlparser/v2"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"github.com/vektah/gqlparser/v2/validator"
+)
+
+const graphQLPath = "/graphql"
+
+type graphQLMock struct {
+	schema        *ast.Schema
+	overrides     map[string]interface{}
+	introspection map[string]interface{}
+	types         map[string]map[string]interface{}
+}
+
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// gqlObject keeps response fields in the order they were selected
+type gqlObject []gqlField
+
+type gqlField struct {
+	key   string
+	value interface{}
+}
+
+// gqlExec resolves a single operation
+type gqlExec struct {
+	gql  *graphQLMock
+	vars map[string]interface{}
+}
+
+func (obj gqlObject) MarshalJSON() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+
+	for i, f := range obj {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key, _ := json.Marshal(f.key)
+		value, err := json.Marshal(f.value)
+
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// loadGraphQL parses the SDL schema and the optional overrides file, a JSON object keyed by Type.field
+func (srv *server) loadGraphQL(schemaFile, dataFile string) error {
+	log.Debug().Msg("entering loadGraphQL")
+	sdl, err := os.ReadFile(schemaFile)
+
+	if err != nil {
+		return err
+	}
+
+	schema, err := gqlparser.LoadSchema(&ast.Source{Name: filepath.Base(schemaFile), Input: string(sdl)})
+
+	if err != nil {
+		return err
+	}
+
+	gql := &graphQLMock{schema: schema, overrides: map[string]interface{}{}}
+
+	if dataFile != "" {
+		data, err := os.ReadFile(dataFile)
+
+		if err != nil {
+			return err
+		}
+
+		if err = json.Unmarshal(data, &gql.overrides); err != nil {
+			return errors.New("invalid overrides file: " + err.Error())
+		}
+
+		for key := range gql.overrides {
+			typ, field, _ := strings.Cut(key, ".")
+
+			if def := schema.Types[typ]; def == nil || def.Fields.ForName(field) == nil {
+				return errors.New("invalid override " + key + ", no such field in the schema")
+			}
+		}
+	}
+
+	gql.buildIntrospection()
+	srv.gql = gql
+	log.Info().
+		Str("schema", schemaFile).
+		Str("overrides", dataFile).
+		Int("types", len(schema.Types)).
+		Msg("GraphQL schema loaded")
+	log.Debug().Msg("leaving loadGraphQL")
+	return nil
+}
+
+func (srv *server) handleGraphQL(next http.HandlerFunc) http.HandlerFunc {
+	log.Debug().Msg("entering handleGraphQL")
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		if srv.gql == nil || req.URL.Path != graphQLPath {
+			next(res, req)
+			return
+		}
+
+		log.Info().
+			Str("protocol", req.Proto).
+			Str("remoteAddress", req.RemoteAddr).
+			Str("method", req.Method).
+			Str("host", req.Host).
+			Str("path", req.RequestURI).
+			Msg("handleGraphQL")
+
+		if entry := requestEntry(req); entry != nil {
+			entry.Mock = "graphql"
+		}
+
+		gqr, err := parseGraphQLRequest(req)
+
+		if err != nil {
+			log.Error().Msg("Invalid GraphQL request: " + err.Error())
+			status := http.StatusBadRequest
+
+			if req.Method != http.MethodGet && req.Method != http.MethodPost {
+				status = http.StatusMethodNotAllowed
+			}
+
+			http.Error(res, http.StatusText(status)+": "+err.Error(), status)
+			return
+		}
+
+		var fragment interface{}
+
+		if xData := req.Header.Get("X-Erised-Data"); xData != "" {
+			if err = json.Unmarshal([]byte(xData), &fragment); err != nil {
+				log.Error().Msg("Invalid X-Erised-Data: " + err.Error())
+				http.Error(res, "Bad Request: X-Erised-Data must be a JSON object", http.StatusBadRequest)
+				return
+			}
+		}
+
+		rsp := gqlObject{}
+		status := http.StatusOK
+		data, errs := srv.gql.execute(gqr, req.Method, fragment)
+
+		if errs != nil && data == nil && errs[0].Rule == "method" {
+			http.Error(res, "Method Not Allowed: "+errs[0].Message, http.StatusMethodNotAllowed)
+			return
+		}
+
+		if data != nil {
+			extra, err := graphQLErrors(req.Header.Get("X-Erised-Errors"))
+
+			if err != nil {
+				log.Error().Msg("Invalid X-Erised-Errors: " + err.Error())
+				http.Error(res, "Bad Request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			for _, e := range extra {
+				nullPath(data, e.Path)
+			}
+
+			errs = append(errs, extra...)
+		}
+
+		if len(errs) > 0 {
+			rsp = append(rsp, gqlField{"errors", errs})
+		}
+
+		if data != nil {
+			rsp = append(rsp, gqlField{"data", data})
+		}
+
+		if xStatusCode := req.Header.Get("X-Erised-Status-Code"); xStatusCode != "" {
+			status = httpStatusCode(xStatusCode)
+		}
+
+		delay := time.Duration(0)
+
+		if xrd, err := strconv.Atoi(req.Header.Get("X-Erised-Response-Delay")); xrd > 0 && err == nil {
+			delay = time.Duration(xrd) * time.Millisecond
+		}
+
+		var hdrs map[string]interface{}
+
+		if err = json.Unmarshal([]byte(req.Header.Get("X-Erised-Headers")), &hdrs); err == nil {
+			for k, v := range hdrs {
+				res.Header().Set(k, fmt.Sprintf("%v", v))
+			}
+		}
+
+		rw, err := srv.throttle(res, req, req.Header.Get("X-Erised-Throughput"))
+
+		if err != nil {
+			http.Error(res, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		body, _ := json.Marshal(rsp)
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(status)
+		srv.respond(rw, encodingJSON, delay, string(body))
+		log.Debug().Msg("leaving handleGraphQL")
+	}
+}
+
+// parseGraphQLRequest accepts GET requests with query parameters, and POST requests with a JSON or application/graphql body
+func parseGraphQLRequest(req *http.Request) (*graphQLRequest, error) {
+	gqr := &graphQLRequest{}
+
+	switch req.Method {
+	case http.MethodGet:
+		gqr.Query = req.URL.Query().Get("query")
+		gqr.OperationName = req.URL.Query().Get("operationName")
+
+		if vars := req.URL.Query().Get("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &gqr.Variables); err != nil {
+				return nil, errors.New("variables must be a JSON object")
+			}
+		}
+	case http.MethodPost:
+		body, err := io.ReadAll(req.Body)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "application/graphql") &&
+			!strings.HasPrefix(req.Header.Get("Content-Type"), "application/graphql-response") {
+			gqr.Query = string(body)
+		} else if err = json.Unmarshal(body, gqr); err != nil {
+			return nil, errors.New("body must be a JSON object with a query")
+		}
+	default:
+		return nil, errors.New("only GET and POST are supported")
+	}
+
+	if strings.TrimSpace(gqr.Query) == "" {
+		return nil, errors.New("missing query")
+	}
+
+	return gqr, nil
+}
+
+// execute validates the operation and returns generated data shaped by its selection set, or the validation errors
+func (gql *graphQLMock) execute(gqr *graphQLRequest, method string, fragment interface{}) (gqlObject, gqlerror.List) {
+	doc, errs := gqlparser.LoadQuery(gql.schema, gqr.Query)
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	var op *ast.OperationDefinition
+
+	if gqr.OperationName != "" {
+		op = doc.Operations.ForName(gqr.OperationName)
+	} else if len(doc.Operations) == 1 {
+		op = doc.Operations[0]
+	}
+
+	if op == nil {
+		return nil, gqlerror.List{gqlerror.Errorf("unknown or ambiguous operation %q", gqr.OperationName)}
+	}
+
+	if op.Operation != ast.Query && method == http.MethodGet {
+		return nil, gqlerror.List{{Message: string(op.Operation) + " operations require POST", Rule: "method"}}
+	}
+
+	vars, err := validator.VariableValues(gql.schema, op, gqr.Variables)
+
+	if err != nil {
+		var gqe *gqlerror.Error
+
+		if errors.As(err, &gqe) {
+			return nil, gqlerror.List{gqe}
+		}
+
+		return nil, gqlerror.List{gqlerror.Errorf("%s", err.Error())}
+	}
+
+	var root *ast.Definition
+
+	switch op.Operation {
+	case ast.Query:
+		root = gql.schema.Query
+	case ast.Mutation:
+		root = gql.schema.Mutation
+	default:
+		return nil, gqlerror.List{gqlerror.Errorf("%s operations are not supported", op.Operation)}
+	}
+
+	src, _ := fragment.(map[string]interface{})
+	ex := &gqlExec{gql: gql, vars: vars}
+	return ex.object(op.SelectionSet, root, src, false), nil
+}
+
+func (ex *gqlExec) object(set ast.SelectionSet, def *ast.Definition, src map[string]interface{}, exact bool) gqlObject {
+	obj := gqlObject{}
+	keys := make([]string, 0)
+	fields := map[string][]*ast.Field{}
+	ex.collect(set, def, &keys, fields)
+
+	for _, key := range keys {
+		f := fields[key][0]
+		sub := ast.SelectionSet{}
+
+		for _, same := range fields[key] {
+			sub = append(sub, same.SelectionSet...)
+		}
+
+		if f.Name == "__typename" {
+			obj = append(obj, gqlField{key, def.Name})
+			continue
+		}
+
+		// sources are looked up by response key first, so aliases can be overridden independently
+		value, found := src[key]
+		fieldExact := exact
+
+		if !found {
+			value, found = src[f.Name]
+		}
+
+		if !found && def == ex.gql.schema.Query && (f.Name == "__schema" || f.Name == "__type") {
+			value, found, fieldExact = ex.gql.introspect(f, ex.vars)
+		}
+
+		if !found {
+			value, found = ex.gql.overrides[def.Name+"."+f.Name]
+		}
+
+		obj = append(obj, gqlField{key, ex.value(f.Definition.Type, sub, value, found, fieldExact)})
+	}
+
+	return obj
+}
+
+// collect flattens fields, fragment spreads and inline fragments that apply to the concrete type
+func (ex *gqlExec) collect(set ast.SelectionSet, def *ast.Definition, keys *[]string, fields map[string][]*ast.Field) {
+	for _, sel := range set {
+		switch s := sel.(type) {
+		case *ast.Field:
+			if !ex.included(s.Directives) {
+				continue
+			}
+
+			key := s.Alias
+
+			if key == "" {
+				key = s.Name
+			}
+
+			if _, ok := fields[key]; !ok {
+				*keys = append(*keys, key)
+			}
+
+			fields[key] = append(fields[key], s)
+		case *ast.FragmentSpread:
+			if ex.included(s.Directives) && s.Definition != nil && ex.applies(s.Definition.TypeCondition, def) {
+				ex.collect(s.Definition.SelectionSet, def, keys, fields)
+			}
+		case *ast.InlineFragment:
+			if ex.included(s.Directives) && ex.applies(s.TypeCondition, def) {
+				ex.collect(s.SelectionSet, def, keys, fields)
+			}
+		}
+	}
+}
+
+// included evaluates @skip and @include
+func (ex *gqlExec) included(directives ast.DirectiveList) bool {
+	if d := directives.ForName("skip"); d != nil {
+		if v, _ := d.ArgumentMap(ex.vars)["if"].(bool); v {
+			return false
+		}
+	}
+
+	if d := directives.ForName("include"); d != nil {
+		if v, _ := d.ArgumentMap(ex.vars)["if"].(bool); !v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (ex *gqlExec) applies(condition string, def *ast.Definition) bool {
+	if condition == "" || condition == def.Name {
+		return true
+	}
+
+	for _, possible := range ex.gql.schema.GetPossibleTypes(ex.gql.schema.Types[condition]) {
+		if possible.Name == def.Name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// value uses the source value when found, and generates one of the right type otherwise.
+// Exact sources, such as introspection, return null for anything missing
+func (ex *gqlExec) value(typ *ast.Type, set ast.SelectionSet, src interface{}, found, exact bool) interface{} {
+	if (found && src == nil) || (!found && exact) {
+		return nil
+	}
+
+	if typ.Elem != nil {
+		items, ok := src.([]interface{})
+
+		if !found || !ok {
+			return []interface{}{ex.value(typ.Elem, set, nil, false, false)}
+		}
+
+		list := make([]interface{}, 0, len(items))
+
+		for _, item := range items {
+			list = append(list, ex.value(typ.Elem, set, item, true, exact))
+		}
+
+		return list
+	}
+
+	def := ex.gql.schema.Types[typ.Name()]
+
+	switch def.Kind {
+	case ast.Scalar:
+		if found {
+			return src
+		}
+
+		return scalarSample(def.Name)
+	case ast.Enum:
+		if found {
+			return src
+		}
+
+		if len(def.EnumValues) > 0 {
+			return def.EnumValues[0].Name
+		}
+
+		return nil
+	default:
+		obj, _ := src.(map[string]interface{})
+
+		if def.IsAbstractType() {
+			def = ex.concrete(def, obj)
+		}
+
+		return ex.object(set, def, obj, exact)
+	}
+}
+
+// concrete picks the type named by the source's __typename, or the first type declared as possible
+func (ex *gqlExec) concrete(def *ast.Definition, src map[string]interface{}) *ast.Definition {
+	possible := ex.gql.schema.GetPossibleTypes(def)
+
+	if name, ok := src["__typename"].(string); ok {
+		for _, p := range possible {
+			if p.Name == name {
+				return p
+			}
+		}
+	}
+
+	if len(possible) == 0 {
+		return def
+	}
+
+	return possible[0]
+}
+
+func scalarSample(name string) interface{} {
+	switch name {
+	case "Int":
+		return 1
+	case "Float":
+		return 1.5
+	case "Boolean":
+		return true
+	case "ID":
+		return "1"
+	case "Date":
+		return stringSample("date")
+	case "DateTime", "Timestamp":
+		return stringSample("date-time")
+	case "Time":
+		return stringSample("time")
+	case "UUID":
+		return stringSample("uuid")
+	case "URL", "URI":
+		return stringSample("uri")
+	case "Email":
+		return stringSample("email")
+	default:
+		return stringSample("")
+	}
+}
+
+// graphQLErrors accepts a JSON list of errors, a single error object or a plain message
+func graphQLErrors(header string) (gqlerror.List, error) {
+	header = strings.TrimSpace(header)
+
+	if header == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(header, "[") && !strings.HasPrefix(header, "{") {
+		return gqlerror.List{{Message: header}}, nil
+	}
+
+	if strings.HasPrefix(header, "{") {
+		header = "[" + header + "]"
+	}
+
+	var raw []struct {
+		Message    string                 `json:"message"`
+		Path       []interface{}          `json:"path"`
+		Extensions map[string]interface{} `json:"extensions"`
+	}
+
+	if err := json.Unmarshal([]byte(header), &raw); err != nil {
+		return nil, errors.New("X-Erised-Errors must be a message, or a JSON error or list of errors")
+	}
+
+	errs := make(gqlerror.List, 0, len(raw))
+
+	for _, r := range raw {
+		e := &gqlerror.Error{Message: r.Message, Extensions: r.Extensions}
+
+		for _, p := range r.Path {
+			switch v := p.(type) {
+			case string:
+				e.Path = append(e.Path, ast.PathName(v))
+			case float64:
+				e.Path = append(e.Path, ast.PathIndex(int(v)))
+			default:
+				return nil, errors.New("error paths can only hold field names and list indexes")
+			}
+		}
+
+		errs = append(errs, e)
+	}
+
+	return errs, nil
+}
+
+// nullPath sets the value at the path of a field error to null
+func nullPath(data interface{}, path ast.Path) {
+	for i, p := range path {
+		last := i == len(path)-1
+
+		switch v := data.(type) {
+		case gqlObject:
+			name, ok := p.(ast.PathName)
+
+			if !ok {
+				return
+			}
+
+			found := false
+
+			for j := range v {
+				if v[j].key == string(name) {
+					if last {
+						v[j].value = nil
+						return
+					}
+
+					data, found = v[j].value, true
+					break
+				}
+			}
+
+			if !found {
+				return
+			}
+		case []interface{}:
+			idx, ok := p.(ast.PathIndex)
+
+			if !ok || int(idx) < 0 || int(idx) >= len(v) {
+				return
+			}
+
+			if last {
+				v[idx] = nil
+				return
+			}
+
+			data = v[idx]
+		default:
+			return
+		}
+	}
+}
+
+// introspect resolves __schema and __type(name:) from the prebuilt introspection data
+func (gql *graphQLMock) introspect(f *ast.Field, vars map[string]interface{}) (interface{}, bool, bool) {
+	if f.Name == "__schema" {
+		return gql.introspection, true, true
+	}
+
+	name, _ := f.ArgumentMap(vars)["name"].(string)
+
+	if t, ok := gql.types[name]; ok {
+		return t, true, true
+	}
+
+	return nil, true, true
+}
+
+// buildIntrospection describes the schema with the __Schema introspection types. Named type references
+// share the full type description, so nested selections on them resolve as expected
+func (gql *graphQLMock) buildIntrospection() {
+	gql.types = map[string]map[string]interface{}{}
+	names := make([]string, 0, len(gql.schema.Types))
+
+	for name := range gql.schema.Types {
+		names = append(names, name)
+		gql.types[name] = map[string]interface{}{}
+	}
+
+	sort.Strings(names)
+	types := make([]interface{}, 0, len(names))
+
+	for _, name := range names {
+		def := gql.schema.Types[name]
+		t := gql.types[name]
+		t["kind"] = string(def.Kind)
+		t["name"] = def.Name
+		t["description"] = description(def.Description)
+
+		switch def.Kind {
+		case ast.Object, ast.Interface:
+			fields := make([]interface{}, 0, len(def.Fields))
+
+			for _, f := range def.Fields {
+				if strings.HasPrefix(f.Name, "__") {
+					continue
+				}
+
+				reason, deprecated := deprecation(f.Directives)
+				fields = append(fields, map[string]interface{}{
+					"name":              f.Name,
+					"description":       description(f.Description),
+					"args":              gql.inputValues(f.Arguments),
+					"type":              gql.typeRef(f.Type),
+					"isDeprecated":      deprecated,
+					"deprecationReason": reason,
+				})
+			}
+
+			interfaces := make([]interface{}, 0, len(def.Interfaces))
+
+			for _, i := range def.Interfaces {
+				interfaces = append(interfaces, gql.types[i])
+			}
+
+			t["fields"], t["interfaces"] = fields, interfaces
+		case ast.Enum:
+			values := make([]interface{}, 0, len(def.EnumValues))
+
+			for _, v := range def.EnumValues {
+				reason, deprecated := deprecation(v.Directives)
+				values = append(values, map[string]interface{}{
+					"name":              v.Name,
+					"description":       description(v.Description),
+					"isDeprecated":      deprecated,
+					"deprecationReason": reason,
+				})
+			}
+
+			t["enumValues"] = values
+		case ast.InputObject:
+			args := make(ast.ArgumentDefinitionList, 0, len(def.Fields))
+
+			for _, f := range def.Fields {
+				args = append(args, &ast.ArgumentDefinition{
+					Name:         f.Name,
+					Description:  f.Description,
+					DefaultValue: f.DefaultValue,
+					Type:         f.Type,
+					Directives:   f.Directives,
+				})
+			}
+
+			t["inputFields"] = gql.inputValues(args)
+			t["isOneOf"] = def.Directives.ForName("oneOf") != nil
+		case ast.Scalar:
+			if d := def.Directives.ForName("specifiedBy"); d != nil {
+				t["specifiedByURL"] = d.ArgumentMap(nil)["url"]
+			}
+		}
+
+		if def.IsAbstractType() {
+			possible := make([]interface{}, 0)
+
+			for _, p := range gql.schema.GetPossibleTypes(def) {
+				possible = append(possible, gql.types[p.Name])
+			}
+
+			t["possibleTypes"] = possible
+		}
+
+		types = append(types, t)
+	}
+
+	directives := make([]interface{}, 0, len(gql.schema.Directives))
+	dnames := make([]string, 0, len(gql.schema.Directives))
+
+	for name := range gql.schema.Directives {
+		dnames = append(dnames, name)
+	}
+
+	sort.Strings(dnames)
+
+	for _, name := range dnames {
+		d := gql.schema.Directives[name]
+		locations := make([]interface{}, 0, len(d.Locations))
+
+		for _, l := range d.Locations {
+			locations = append(locations, string(l))
+		}
+
+		directives = append(directives, map[string]interface{}{
+			"name":         d.Name,
+			"description":  description(d.Description),
+			"locations":    locations,
+			"args":         gql.inputValues(d.Arguments),
+			"isRepeatable": d.IsRepeatable,
+		})
+	}
+
+	gql.introspection = map[string]interface{}{
+		"description":      description(gql.schema.Description),
+		"types":            types,
+		"queryType":        gql.namedType(gql.schema.Query),
+		"mutationType":     gql.namedType(gql.schema.Mutation),
+		"subscriptionType": gql.namedType(gql.schema.Subscription),
+		"directives":       directives,
+	}
+}
+
+func (gql *graphQLMock) namedType(def *ast.Definition) interface{} {
+	if def == nil {
+		return nil
+	}
+
+	return gql.types[def.Name]
+}
+
+func (gql *graphQLMock) typeRef(typ *ast.Type) interface{} {
+	var ref interface{} = gql.types[typ.NamedType]
+
+	if typ.Elem != nil {
+		ref = map[string]interface{}{"kind": "LIST", "name": nil, "ofType": gql.typeRef(typ.Elem)}
+	}
+
+	if typ.NonNull {
+		ref = map[string]interface{}{"kind": "NON_NULL", "name": nil, "ofType": ref}
+	}
+
+	return ref
+}
+
+func (gql *graphQLMock) inputValues(args ast.ArgumentDefinitionList) []interface{} {
+	values := make([]interface{}, 0, len(args))
+
+	for _, a := range args {
+		reason, deprecated := deprecation(a.Directives)
+		var def interface{}
+
+		if a.DefaultValue != nil {
+			def = a.DefaultValue.String()
+		}
+
+		values = append(values, map[string]interface{}{
+			"name":              a.Name,
+			"description":       description(a.Description),
+			"type":              gql.typeRef(a.Type),
+			"defaultValue":      def,
+			"isDeprecated":      deprecated,
+			"deprecationReason": reason,
+		})
+	}
+
+	return values
+}
+
+func deprecation(directives ast.DirectiveList) (interface{}, bool) {
+	d := directives.ForName("deprecated")
+
+	if d == nil {
+		return nil, false
+	}
+
+	if reason, ok := d.ArgumentMap(nil)["reason"].(string); ok {
+		return reason, true
+	}
+
+	return "No longer supported", true
+}
+
+func description(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+
+	return s
+}
+
+// String is used when logging responses
+func (obj gqlObject) String() string {
+	data, err := json.Marshal(obj)
+
+	if err != nil {
+		return fmt.Sprintf("%v", []gqlField(obj))
+	}
+
+	return string(data)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+)
+
+func TestErisedGraphQL(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	svr := server{}
+	post := func(body string, hdrs map[string]string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/graphql", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		for k, v := range hdrs {
+			req.Header.Set(k, v)
+		}
+
+		svr.handleGraphQL(svr.handleLanding()).ServeHTTP(res, req)
+		return res
+	}
+
+	g.Describe("Test GraphQL schema", func() {
+		g.It("Should load serverGraphQL_test.graphql", func() {
+			Ω(svr.loadGraphQL("serverGraphQL_test.graphql", "serverGraphQL_test.json")).Should(Succeed())
+		})
+
+		g.It("Should fail to load invalid schemas and overrides", func() {
+			other := server{}
+			Ω(other.loadGraphQL("serverMocks_test.yaml", "")).ShouldNot(Succeed())
+			Ω(other.loadGraphQL("serverGraphQL_test.graphql", "serverMocks_test.yaml")).ShouldNot(Succeed())
+			Ω(other.gql).Should(BeNil())
+		})
+
+		g.It("Should fall through for other paths", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/graphqlx", nil)
+			req.Header.Set("X-Erised-Data", "fallback")
+			svr.handleGraphQL(svr.handleLanding()).ServeHTTP(res, req)
+
+			Ω(res.Body.String()).Should(Equal("fallback"))
+		})
+	})
+
+	g.Describe("Test GraphQL queries", func() {
+		g.It("Should generate data of the right shape", func() {
+			res := post(`{"query":"{ random { id value category rating createdAt author { name jokes { id } } } }"}`, nil)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(res.Header().Get("Content-Type")).Should(Equal("application/json"))
+			Ω(res.Body.String()).Should(Equal(`{"data":{"random":{"id":"1","value":"Chuck Norris can divide by zero.","category":"DEV","rating":1.5,"createdAt":"2020-12-30T11:21:32Z","author":{"name":"Chuck Norris","jokes":[{"id":"1"}]}}}}`))
+		})
+
+		g.It("Should honour aliases, fragments and directives", func() {
+			res := post(`{"query":"query Q($full: Boolean!) { first: random { ...parts } second: random @skip(if: true) { id } }  fragment parts on Joke { id value @include(if: $full) __typename }","variables":{"full":false}}`, nil)
+
+			Ω(res.Body.String()).Should(Equal(`{"data":{"first":{"id":"1","__typename":"Joke"}}}`))
+		})
+
+		g.It("Should resolve abstract types", func() {
+			res := post(`{"query":"{ search(text: \"chuck\") { __typename ... on Author { name } ... on Joke { value } } }"}`,
+				map[string]string{"X-Erised-Data": `{"search":[{"__typename":"Joke","value":"one"},{"__typename":"Author"}]}`})
+
+			Ω(res.Body.String()).Should(MatchJSON(`{"data":{"search":[{"__typename":"Joke","value":"one"},{"__typename":"Author","name":"Chuck Norris"}]}}`))
+		})
+
+		g.It("Should merge X-Erised-Data by response key", func() {
+			res := post(`{"query":"{ a: random { value } b: random { value } }"}`,
+				map[string]string{"X-Erised-Data": `{"b":{"value":"Chuck Norris doesn't mock, he just tells you what you want."}}`})
+
+			Ω(res.Body.String()).Should(MatchJSON(`{"data":{"a":{"value":"Chuck Norris can divide by zero."},"b":{"value":"Chuck Norris doesn't mock, he just tells you what you want."}}}`))
+		})
+
+		g.It("Should accept GET and application/graphql requests", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/graphql?query="+url.QueryEscape("{ jokes { id } }"), nil)
+			svr.handleGraphQL(svr.handleLanding()).ServeHTTP(res, req)
+			Ω(res.Body.String()).Should(MatchJSON(`{"data":{"jokes":[{"id":"1"}]}}`))
+
+			res = httptest.NewRecorder()
+			req = httptest.NewRequest(http.MethodPost, "http://localhost:8080/graphql", strings.NewReader("{ node(id: 1) { id } }"))
+			req.Header.Set("Content-Type", "application/graphql")
+			svr.handleGraphQL(svr.handleLanding()).ServeHTTP(res, req)
+			Ω(res.Body.String()).Should(MatchJSON(`{"data":{"node":{"id":"1"}}}`))
+		})
+
+		g.It("Should only run mutations over POST", func() {
+			mutation := `mutation { addJoke(joke: {value: "new"}) { id } }`
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/graphql?query="+url.QueryEscape(mutation), nil)
+			svr.handleGraphQL(svr.handleLanding()).ServeHTTP(res, req)
+			Ω(res).Should(HaveHTTPStatus(http.StatusMethodNotAllowed))
+
+			res = post(`{"query":"`+strings.ReplaceAll(mutation, `"`, `\"`)+`"}`, nil)
+			Ω(res.Body.String()).Should(MatchJSON(`{"data":{"addJoke":{"id":"1"}}}`))
+		})
+
+		g.It("Should return validation errors", func() {
+			res := post(`{"query":"{ random { punchline } }"}`, nil)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(res.Body.String()).Should(ContainSubstring(`Cannot query field \"punchline\" on type \"Joke\".`))
+			Ω(res.Body.String()).ShouldNot(ContainSubstring(`"data"`))
+		})
+
+		g.It("Should return BadRequest for invalid requests", func() {
+			Ω(post(`{"variables":{}}`, nil)).Should(HaveHTTPStatus(http.StatusBadRequest))
+			Ω(post(`{ random { id } }`, nil)).Should(HaveHTTPStatus(http.StatusBadRequest))
+		})
+	})
+
+	g.Describe("Test GraphQL errors", func() {
+		g.It("Should return X-Erised-Errors and null their paths", func() {
+			res := post(`{"query":"{ random { id value } }"}`, map[string]string{
+				"X-Erised-Errors":      `{"message":"joke not found","path":["random","value"],"extensions":{"code":"NOT_FOUND"}}`,
+				"X-Erised-Status-Code": "OK",
+			})
+
+			Ω(res.Body.String()).Should(MatchJSON(`{"errors":[{"message":"joke not found","path":["random","value"],"extensions":{"code":"NOT_FOUND"}}],"data":{"random":{"id":"1","value":null}}}`))
+		})
+
+		g.It("Should accept plain error messages", func() {
+			res := post(`{"query":"{ random { id } }"}`, map[string]string{"X-Erised-Errors": "something went wrong"})
+
+			Ω(res.Body.String()).Should(MatchJSON(`{"errors":[{"message":"something went wrong"}],"data":{"random":{"id":"1"}}}`))
+		})
+
+		g.It("Should return BadRequest for invalid X-Erised-Errors", func() {
+			res := post(`{"query":"{ random { id } }"}`, map[string]string{"X-Erised-Errors": `[{"message":1}]`})
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusBadRequest))
+		})
+	})
+
+	g.Describe("Test GraphQL introspection", func() {
+		g.It("Should describe the schema", func() {
+			res := post(`{"query":"{ __schema { queryType { name fields { name } } mutationType { name } subscriptionType { name } } }"}`, nil)
+
+			Ω(res.Body.String()).Should(MatchJSON(`{"data":{"__schema":{"queryType":{"name":"Query","fields":[{"name":"random"},{"name":"jokes"},{"name":"node"},{"name":"search"}]},"mutationType":{"name":"Mutation"},"subscriptionType":null}}}`))
+		})
+
+		g.It("Should describe types", func() {
+			res := post(`{"query":"{ __type(name: \"Node\") { kind possibleTypes { name } } enum: __type(name: \"Category\") { enumValues { name } } missing: __type(name: \"Nope\") { name } }"}`, nil)
+
+			Ω(res.Body.String()).Should(MatchJSON(`{"data":{"__type":{"kind":"INTERFACE","possibleTypes":[{"name":"Joke"},{"name":"Author"}]},"enum":{"enumValues":[{"name":"DEV"},{"name":"MOVIE"},{"name":"SCIENCE"}]},"missing":null}}`))
+		})
+
+		g.It("Should resolve data fields after introspection fields", func() {
+			res := post(`{"query":"{ __type(name: \"Query\") { name } jokes { __typename } }"}`, nil)
+
+			Ω(res.Body.String()).Should(HavePrefix(`{"data":{"__type":{"name":"Query"},"jokes":[{"__typename":"Joke"}`))
+		})
+	})
+}
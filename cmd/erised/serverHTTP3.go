@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/rs/zerolog/log"
+)
+
+// setupHTTP3 serves the same handlers over QUIC, on the UDP port matching the HTTPS port
+func (srv *server) setupHTTP3() error {
+	log.Debug().Msg("entering setupHTTP3")
+
+	if len(srv.crt) == 0 {
+		return errors.New("HTTP/3 requires a certificate")
+	}
+
+	// client authentication and certificate reloading, when enabled, apply to QUIC connections too
+	cfg := &tls.Config{GetCertificate: srv.crt.getCertificate}
+
+	if srv.cfg.TLSConfig != nil {
+		cfg = srv.cfg.TLSConfig.Clone()
+	}
+
+	srv.h3 = &http3.Server{
+		Addr:        srv.cfg.Addr,
+		Handler:     srv.cfg.Handler,
+		TLSConfig:   http3.ConfigureTLSConfig(cfg),
+		IdleTimeout: srv.cfg.IdleTimeout,
+	}
+
+	srv.cfg.Handler = srv.handleAltSvc(srv.cfg.Handler)
+	log.Debug().Msg("leaving setupHTTP3")
+	return nil
+}
+
+// handleAltSvc advertises the HTTP/3 listener on responses sent over TCP
+func (srv *server) handleAltSvc(next http.Handler) http.Handler {
+	log.Debug().Msg("entering handleAltSvc")
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor < 3 {
+			if err := srv.h3.SetQUICHeaders(res.Header()); err != nil {
+				log.Debug().Msg("Alt-Svc not set: " + err.Error())
+			}
+		}
+
+		next.ServeHTTP(res, req)
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/rs/zerolog"
+)
+
+func TestErisedHTTP3(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	pem, _ := os.ReadFile("certs/localCA.pem")
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pem)
+
+	// reserve a UDP port, so HTTP/3 can listen on it
+	udp, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	port := udp.LocalAddr().(*net.UDPAddr).Port
+	_ = udp.Close()
+
+	svr := &server{}
+	svr.cfg = &http.Server{Addr: "127.0.0.1:" + strconv.Itoa(port), Handler: svr.handleProtocol(svr.handleLanding())}
+	client := &http.Client{Transport: &http3.RoundTripper{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost"}}}
+	defer func() { _ = client.Transport.(*http3.RoundTripper).Close() }()
+
+	g.Describe("Test HTTP/3", func() {
+		g.It("Should fail without certificates", func() {
+			Ω(svr.setupHTTP3()).ShouldNot(Succeed())
+		})
+
+		g.It("Should serve requests over QUIC", func() {
+			Ω(svr.setupCertificates("certs/erised.crt,certs/erised.crt", "certs/erised.key,certs/erised.key")).Should(Succeed())
+			Ω(svr.setupHTTP3()).Should(Succeed())
+			go func() { _ = svr.h3.ListenAndServe() }()
+
+			req, _ := http.NewRequest(http.MethodGet, "https://"+svr.cfg.Addr+"/", nil)
+			req.Header.Set("X-Erised-Data", "Hello over QUIC")
+			var res *http.Response
+
+			Eventually(func() error {
+				var err error
+				res, err = client.Do(req)
+				return err
+			}).Should(Succeed())
+			Ω(res.ProtoMajor).Should(Equal(3))
+			Ω(res.Header.Get("Alt-Svc")).Should(BeEmpty())
+			Ω(res).Should(HaveHTTPBody("Hello over QUIC"))
+		})
+
+		g.It("Should advertise HTTP/3 with Alt-Svc over TCP", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "https://localhost/", nil)
+			svr.cfg.Handler.ServeHTTP(res, req)
+
+			Ω(res.Header().Get("Alt-Svc")).Should(Equal(`h3=":` + strconv.Itoa(port) + `"; ma=2592000`))
+		})
+
+		g.It("Should reject requests with H3_VERSION_FALLBACK", func() {
+			req, _ := http.NewRequest(http.MethodGet, "https://"+svr.cfg.Addr+"/", nil)
+			req.Header.Set("X-Erised-Protocol", "HTTP/1.1")
+			_, err := client.Do(req)
+
+			Ω(err).Should(MatchError(ContainSubstring(http3.ErrCodeVersionFallback.String())))
+		})
+
+		g.It("Should close the listener", func() {
+			Ω(svr.h3.Close()).Should(Succeed())
+		})
+	})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type journalEntry struct {
+	Time          time.Time   `json:"time"`
+	Protocol      string      `json:"protocol"`
+	RemoteAddress string      `json:"remoteAddress"`
+	Method        string      `json:"method"`
+	Host          string      `json:"host"`
+	Path          string      `json:"path"`
+	Query         string      `json:"query,omitempty"`
+	Headers       http.Header `json:"headers"`
+	Body          string      `json:"body,omitempty"`
+	BodyTruncated bool        `json:"bodyTruncated,omitempty"`
+	Mock          string      `json:"mock,omitempty"`
+	Fault         string      `json:"fault,omitempty"`
+	Toxics        []string    `json:"toxics,omitempty"`
+	Outage        string      `json:"outage,omitempty"`
+	Status        int         `json:"status"`
+	Violations    []string    `json:"violations,omitempty"`
+}
+
+type journalFilter struct {
+	Method  string            `json:"method,omitempty"`
+	Path    string            `json:"path,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Mock    string            `json:"mock,omitempty"`
+}
+
+type journal struct {
+	mtx       sync.RWMutex
+	entries   []*journalEntry
+	next      int
+	full      bool
+	bodyLimit int
+}
+
+type journalWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+type journalKey struct{}
+
+// journalBodyLimit is the default number of bytes of each request body kept in the journal
+const journalBodyLimit = 64 << 10
+
+func newJournal(size int) *journal {
+	if size <= 0 {
+		return nil
+	}
+
+	return &journal{entries: make([]*journalEntry, size), bodyLimit: journalBodyLimit}
+}
+
+func (jnl *journal) add(entry *journalEntry) {
+	jnl.mtx.Lock()
+	defer jnl.mtx.Unlock()
+
+	jnl.entries[jnl.next] = entry
+	jnl.next = (jnl.next + 1) % len(jnl.entries)
+	jnl.full = jnl.full || jnl.next == 0
+}
+
+// list returns the matching entries, oldest first
+func (jnl *journal) list(flt journalFilter) []*journalEntry {
+	jnl.mtx.RLock()
+	defer jnl.mtx.RUnlock()
+	entries := make([]*journalEntry, 0)
+	start := 0
+
+	if jnl.full {
+		start = jnl.next
+	}
+
+	for i := 0; i < len(jnl.entries); i++ {
+		entry := jnl.entries[(start+i)%len(jnl.entries)]
+
+		if entry == nil {
+			break
+		}
+
+		if flt.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+func (jnl *journal) clear() {
+	jnl.mtx.Lock()
+	defer jnl.mtx.Unlock()
+
+	jnl.entries = make([]*journalEntry, len(jnl.entries))
+	jnl.next = 0
+	jnl.full = false
+}
+
+func (flt journalFilter) matches(entry *journalEntry) bool {
+	if flt.Method != "" && !strings.EqualFold(flt.Method, entry.Method) {
+		return false
+	}
+
+	if flt.Path != "" {
+		if _, ok := matchPath(flt.Path, entry.Path); !ok {
+			return false
+		}
+	}
+
+	for k, v := range flt.Headers {
+		if entry.Headers.Get(k) != v {
+			return false
+		}
+	}
+
+	return flt.Mock == "" || flt.Mock == entry.Mock
+}
+
+// requestEntry returns the journal entry being recorded for the request, if any
+func requestEntry(req *http.Request) *journalEntry {
+	entry, _ := req.Context().Value(journalKey{}).(*journalEntry)
+	return entry
+}
+
+func (jw *journalWriter) WriteHeader(status int) {
+	if jw.status == 0 {
+		jw.status = status
+	}
+
+	jw.ResponseWriter.WriteHeader(status)
+}
+
+func (jw *journalWriter) Write(data []byte) (int, error) {
+	if jw.status == 0 {
+		jw.status = http.StatusOK
+	}
+
+	return jw.ResponseWriter.Write(data)
+}
+
+func (jw *journalWriter) Unwrap() http.ResponseWriter {
+	return jw.ResponseWriter
+}
+
+func (jw *journalWriter) Flush() {
+	if f, ok := jw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack records hijacked connections, such as WebSocket upgrades, as switching protocols. Connections
+// hijacked to inject faults record their own status
+func (jw *journalWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(jw.ResponseWriter).Hijack()
+
+	if err == nil && jw.status == 0 {
+		jw.status = http.StatusSwitchingProtocols
+	}
+
+	return conn, rw, err
+}
+
+func (srv *server) handleJournal(next http.Handler) http.Handler {
+	log.Debug().Msg("entering handleJournal")
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if srv.jnl == nil || strings.HasPrefix(req.URL.Path, "/erised/requests") {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		body, truncated, err := peekBody(req, srv.jnl.bodyLimit)
+
+		if err != nil {
+			log.Error().Msg("Error reading request body: " + err.Error())
+		}
+
+		entry := &journalEntry{
+			Time:          time.Now(),
+			Protocol:      req.Proto,
+			RemoteAddress: req.RemoteAddr,
+			Method:        req.Method,
+			Host:          req.Host,
+			Path:          req.URL.Path,
+			Query:         req.URL.RawQuery,
+			Headers:       req.Header.Clone(),
+			Body:          string(body),
+			BodyTruncated: truncated,
+		}
+
+		jw := &journalWriter{ResponseWriter: res}
+
+		// aborted requests are recorded too. Faults set the status actually sent, if any
+		defer func() {
+			if entry.Fault == "" {
+				if entry.Status = jw.status; entry.Status == 0 {
+					entry.Status = http.StatusOK
+				}
+			}
+
+			srv.jnl.add(entry)
+			log.Debug().Msg("leaving handleJournal")
+		}()
+
+		next.ServeHTTP(jw, req.WithContext(context.WithValue(req.Context(), journalKey{}, entry)))
+	})
+}
+
+// peekBody reads up to limit bytes of the request body, and whether there is more of it. The whole body
+// is still streamed to the handlers, so large uploads are never buffered in full
+func peekBody(req *http.Request, limit int) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody || limit <= 0 {
+		return nil, false, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(req.Body, int64(limit)+1))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), req.Body), req.Body}
+
+	if len(data) > limit {
+		return data[:limit], true, err
+	}
+
+	return data, false, err
+}
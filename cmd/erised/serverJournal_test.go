@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+)
+
+func TestErisedJournal(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	svr := server{mck: &mockStore{}, jnl: newJournal(3)}
+	_ = svr.mck.add(&mockRule{ID: "teapot", Path: "/brew", mockResponse: mockResponse{Status: http.StatusTeapot}})
+	hnd := svr.handleJournal(svr.handleMocks(svr.handleLanding()))
+
+	g.Describe("Test request journal", func() {
+		g.It("Should record requests", func() {
+			req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/brew?cups=2", strings.NewReader("earl grey"))
+			req.Header.Set("Authorization", "Bearer token")
+			hnd.ServeHTTP(httptest.NewRecorder(), req)
+			entries := svr.jnl.list(journalFilter{})
+
+			Ω(entries).Should(HaveLen(1))
+			Ω(entries[0].Method).Should(Equal(http.MethodPost))
+			Ω(entries[0].Path).Should(Equal("/brew"))
+			Ω(entries[0].Query).Should(Equal("cups=2"))
+			Ω(entries[0].Body).Should(Equal("earl grey"))
+			Ω(entries[0].Mock).Should(Equal("teapot"))
+			Ω(entries[0].Status).Should(Equal(http.StatusTeapot))
+		})
+
+		g.It("Should keep only the latest requests", func() {
+			for _, p := range []string{"/one", "/two", "/three"} {
+				hnd.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost:8080"+p, nil))
+			}
+
+			entries := svr.jnl.list(journalFilter{})
+
+			Ω(entries).Should(HaveLen(3))
+			Ω(entries[0].Path).Should(Equal("/one"))
+			Ω(entries[2].Path).Should(Equal("/three"))
+		})
+
+		g.It("Should filter requests", func() {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/brew", nil)
+			req.Header.Set("Authorization", "Bearer token")
+			hnd.ServeHTTP(httptest.NewRecorder(), req)
+
+			Ω(svr.jnl.list(journalFilter{Path: "/t*"})).Should(HaveLen(0))
+			Ω(svr.jnl.list(journalFilter{Path: "/*"})).Should(HaveLen(3))
+			Ω(svr.jnl.list(journalFilter{Method: "get", Headers: map[string]string{"Authorization": "Bearer token"}})).Should(HaveLen(1))
+			Ω(svr.jnl.list(journalFilter{Mock: "teapot"})).Should(HaveLen(1))
+		})
+
+		g.It("Should keep only the start of large bodies", func() {
+			small := server{jnl: newJournal(3)}
+			small.jnl.bodyLimit = 4
+			received := 0
+			hnd := small.handleJournal(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				data, _ := io.ReadAll(req.Body)
+				received = len(data)
+			}))
+
+			hnd.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "http://localhost:8080/upload", strings.NewReader("0123456789")))
+			Ω(received).Should(Equal(10))
+			hnd.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "http://localhost:8080/upload", strings.NewReader("0123")))
+			entries := small.jnl.list(journalFilter{})
+
+			Ω(entries[0].Body).Should(Equal("0123"))
+			Ω(entries[0].BodyTruncated).Should(BeTrue())
+			Ω(entries[1].Body).Should(Equal("0123"))
+			Ω(entries[1].BodyTruncated).Should(BeFalse())
+		})
+	})
+
+	g.Describe("Test erised/requests", func() {
+		g.It("Should return filtered requests", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/erised/requests?path=/brew&header=Authorization:Bearer%20token", nil)
+			svr.handleRequests().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(res.Header().Get("Content-Type")).Should(Equal("application/json"))
+			Ω(res.Body.String()).Should(ContainSubstring(`"mock":"teapot"`))
+		})
+
+		g.It("Should count requests", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/erised/requests/count", strings.NewReader(`{"path":"/two"}`))
+			svr.handleRequestsCount().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(res.Body.String()).Should(Equal(`{"count":1}`))
+		})
+
+		g.It("Should return BadRequest", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/erised/requests/count", strings.NewReader(`{"path":`))
+			svr.handleRequestsCount().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusBadRequest))
+		})
+
+		g.It("Should return MethodNotAllowed", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/erised/requests/count", nil)
+			svr.handleRequestsCount().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusMethodNotAllowed))
+		})
+
+		g.It("Should reset the journal", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodDelete, "http://localhost:8080/erised/requests", nil)
+			svr.handleRequests().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusNoContent))
+			Ω(svr.jnl.list(journalFilter{})).Should(BeEmpty())
+		})
+	})
+}
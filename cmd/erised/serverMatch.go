@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+)
+
+type valueMatcher struct {
+	Equals  interface{}
+	Matches string
+	re      *regexp.Regexp
+}
+
+type requestMatcher struct {
+	Query    map[string]*valueMatcher `json:"query,omitempty"`
+	Headers  map[string]*valueMatcher `json:"headers,omitempty"`
+	JSONPath map[string]*valueMatcher `json:"jsonPath,omitempty"`
+	Contains interface{}              `json:"contains,omitempty"`
+}
+
+// UnmarshalJSON accepts either a plain value, compared for equality, or an object with an equals or matches (regex) key
+func (vm *valueMatcher) UnmarshalJSON(data []byte) error {
+	var v interface{}
+
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	if obj, ok := v.(map[string]interface{}); ok && len(obj) == 1 {
+		if eq, found := obj["equals"]; found {
+			vm.Equals = eq
+			return nil
+		}
+
+		if re, found := obj["matches"]; found {
+			if vm.Matches, ok = re.(string); !ok {
+				return errors.New("matches requires a regular expression")
+			}
+
+			return nil
+		}
+	}
+
+	vm.Equals = v
+	return nil
+}
+
+func (vm *valueMatcher) MarshalJSON() ([]byte, error) {
+	if vm.Matches != "" {
+		return json.Marshal(map[string]string{"matches": vm.Matches})
+	}
+
+	return json.Marshal(vm.Equals)
+}
+
+func (vm *valueMatcher) compile() (err error) {
+	if vm.Matches != "" {
+		vm.re, err = regexp.Compile(vm.Matches)
+	}
+
+	return err
+}
+
+// matchString compares query and header values, where numbers and booleans are compared by their text
+func (vm *valueMatcher) matchString(value string) bool {
+	if vm.re != nil {
+		return vm.re.MatchString(value)
+	}
+
+	// %v would print large numbers in e-notation, e.g. 1e+06
+	if f, ok := vm.Equals.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64) == value
+	}
+
+	return fmt.Sprintf("%v", vm.Equals) == value
+}
+
+func (vm *valueMatcher) matchValue(value interface{}) bool {
+	if vm.re != nil {
+		if s, ok := value.(string); ok {
+			return vm.re.MatchString(s)
+		}
+
+		data, _ := json.Marshal(value)
+		return vm.re.Match(data)
+	}
+
+	return reflect.DeepEqual(vm.Equals, value)
+}
+
+func (rm *requestMatcher) validate() error {
+	for _, group := range []map[string]*valueMatcher{rm.Query, rm.Headers, rm.JSONPath} {
+		for k, vm := range group {
+			if vm == nil {
+				return errors.New("missing value for " + k)
+			}
+
+			if err := vm.compile(); err != nil {
+				return errors.New("invalid regular expression for " + k + ": " + err.Error())
+			}
+		}
+	}
+
+	for expr := range rm.JSONPath {
+		if _, err := parseJSONPath(expr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (rm *requestMatcher) needsBody() bool {
+	return rm != nil && (len(rm.JSONPath) > 0 || rm.Contains != nil)
+}
+
+func (rm *requestMatcher) matches(req *http.Request, body interface{}, validBody bool) bool {
+	if rm == nil {
+		return true
+	}
+
+	for k, vm := range rm.Query {
+		if !req.URL.Query().Has(k) || !vm.matchString(req.URL.Query().Get(k)) {
+			return false
+		}
+	}
+
+	for k, vm := range rm.Headers {
+		if _, ok := req.Header[http.CanonicalHeaderKey(k)]; !ok || !vm.matchString(req.Header.Get(k)) {
+			return false
+		}
+	}
+
+	if rm.needsBody() && !validBody {
+		return false
+	}
+
+	for expr, vm := range rm.JSONPath {
+		if v, ok, _ := evalJSONPath(body, expr); !ok || !vm.matchValue(v) {
+			return false
+		}
+	}
+
+	return rm.Contains == nil || contains(body, rm.Contains)
+}
+
+// contains reports whether every field in expected is present in actual. Lists match when
+// each expected element is contained in some element of the actual list
+func contains(actual, expected interface{}) bool {
+	switch exp := expected.(type) {
+	case map[string]interface{}:
+		act, ok := actual.(map[string]interface{})
+
+		if !ok {
+			return false
+		}
+
+		for k, v := range exp {
+			if a, found := act[k]; !found || !contains(a, v) {
+				return false
+			}
+		}
+
+		return true
+	case []interface{}:
+		act, ok := actual.([]interface{})
+
+		if !ok {
+			return false
+		}
+
+		for _, v := range exp {
+			found := false
+
+			for _, a := range act {
+				if found = contains(a, v); found {
+					break
+				}
+			}
+
+			if !found {
+				return false
+			}
+		}
+
+		return true
+	default:
+		return reflect.DeepEqual(actual, expected)
+	}
+}
+
+// jsonBody reads and restores the request body, returning it decoded when it is valid JSON
+func jsonBody(req *http.Request) (interface{}, bool) {
+	data, err := io.ReadAll(req.Body)
+
+	if err != nil {
+		return nil, false
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	var body interface{}
+
+	if err = json.Unmarshal(data, &body); err != nil {
+		return nil, false
+	}
+
+	return body, true
+}
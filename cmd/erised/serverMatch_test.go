@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+)
+
+func TestErisedMatching(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	svr := server{mck: &mockStore{}}
+	rules, err := parseMocks([]byte(`
+- path: /rpc
+  body: unknown
+- path: /rpc
+  priority: 1
+  match:
+    jsonPath:
+      $.action: create
+      $.items[0].qty: 2
+  body: created
+- path: /rpc
+  priority: 1
+  match:
+    contains:
+      action: delete
+      ids: [3]
+  body: deleted
+- path: /search
+  match:
+    query:
+      page: 2
+    headers:
+      authorization:
+        matches: ^Bearer\s
+  body: page two
+- path: /search
+  match:
+    query:
+      page: 1000000
+      ratio: 0.5
+  body: last page
+`))
+	_ = svr.mck.add(rules...)
+	hnd := svr.handleMocks(svr.handleLanding())
+	call := func(req *http.Request) string {
+		res := httptest.NewRecorder()
+		hnd.ServeHTTP(res, req)
+		return res.Body.String()
+	}
+
+	g.Describe("Test request matching", func() {
+		g.It("Should load matching criteria", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(rules).Should(HaveLen(5))
+		})
+
+		g.It("Should match JSONPath values", func() {
+			req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/rpc", strings.NewReader(`{"action":"create","items":[{"qty":2}]}`))
+			Ω(call(req)).Should(Equal("created"))
+
+			req = httptest.NewRequest(http.MethodPost, "http://localhost:8080/rpc", strings.NewReader(`{"action":"create","items":[{"qty":3}]}`))
+			Ω(call(req)).Should(Equal("unknown"))
+		})
+
+		g.It("Should match partial objects", func() {
+			req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/rpc", strings.NewReader(`{"action":"delete","ids":[1,2,3],"force":true}`))
+			Ω(call(req)).Should(Equal("deleted"))
+
+			req = httptest.NewRequest(http.MethodPost, "http://localhost:8080/rpc", strings.NewReader(`not json`))
+			Ω(call(req)).Should(Equal("unknown"))
+		})
+
+		g.It("Should match query parameters and headers", func() {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/search?page=2", nil)
+			req.Header.Set("Authorization", "Bearer token")
+			Ω(call(req)).Should(Equal("page two"))
+
+			req = httptest.NewRequest(http.MethodGet, "http://localhost:8080/search?page=2", nil)
+			req.Header.Set("Authorization", "Basic dXNlcg==")
+			req.Header.Set("X-Erised-Data", "fallback")
+			Ω(call(req)).Should(Equal("fallback"))
+
+			req = httptest.NewRequest(http.MethodGet, "http://localhost:8080/search?page=1000000&ratio=0.5", nil)
+			Ω(call(req)).Should(Equal("last page"))
+		})
+
+		g.It("Should keep matching other requests while a body is being read", func() {
+			pr, pw := io.Pipe()
+			reading := make(chan struct{})
+			var once sync.Once
+			body := readerFunc(func(p []byte) (int, error) { once.Do(func() { close(reading) }); return pr.Read(p) })
+			slow := make(chan string)
+			go func() { slow <- call(httptest.NewRequest(http.MethodPost, "http://localhost:8080/rpc", body)) }()
+			Eventually(reading).Should(BeClosed())
+
+			fast := make(chan string)
+			go func() {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/search?page=2", nil)
+				req.Header.Set("Authorization", "Bearer token")
+				fast <- call(req)
+			}()
+
+			Eventually(fast).Should(Receive(Equal("page two")))
+			_, _ = io.WriteString(pw, `{"action":"create","items":[{"qty":2}]}`)
+			_ = pw.Close()
+			Eventually(slow).Should(Receive(Equal("created")))
+		})
+
+		g.It("Should reject invalid criteria", func() {
+			_, err := parseMocks([]byte(`{"path":"/","match":{"headers":{"a":{"matches":"("}}}}`))
+			Ω(err).Should(HaveOccurred())
+
+			_, err = parseMocks([]byte(`{"path":"/","match":{"jsonPath":{"a.b":1}}}`))
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,671 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+type statusCode int
+
+type mockBody string
+
+type mockResponse struct {
+	Status      statusCode             `json:"status,omitempty"`
+	ContentType string                 `json:"contentType,omitempty"`
+	Headers     map[string]interface{} `json:"headers,omitempty"`
+	Body        mockBody               `json:"body,omitempty"`
+	BodyFile    string                 `json:"bodyFile,omitempty"`
+	Delay       int                    `json:"delay,omitempty"`
+	Throughput  string                 `json:"throughput,omitempty"`
+	Latency     string                 `json:"latency,omitempty"`
+	FailureRate string                 `json:"failureRate,omitempty"`
+	Template    bool                   `json:"template,omitempty"`
+	Fault       string                 `json:"fault,omitempty"`
+}
+
+type mockRule struct {
+	ID       string          `json:"id"`
+	Host     string          `json:"host,omitempty"`
+	Method   string          `json:"method,omitempty"`
+	Path     string          `json:"path"`
+	Match    *requestMatcher `json:"match,omitempty"`
+	Priority int             `json:"priority,omitempty"`
+	mockResponse
+	Responses []mockResponse `json:"responses,omitempty"`
+	Cycle     bool           `json:"cycle,omitempty"`
+	Scenario  string         `json:"scenario,omitempty"`
+	WhenState string         `json:"whenState,omitempty"`
+	NewState  string         `json:"newState,omitempty"`
+}
+
+type mockStore struct {
+	mtx    sync.RWMutex
+	rules  []*mockRule
+	seq    int
+	hits   map[string]int
+	states map[string]string
+}
+
+const scenarioStarted = "Started"
+
+// UnmarshalJSON accepts numeric codes as well as the names understood by X-Erised-Status-Code
+func (sc *statusCode) UnmarshalJSON(data []byte) error {
+	var v interface{}
+
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	switch code := v.(type) {
+	case float64:
+		*sc = statusCode(code)
+	case string:
+		if n, err := strconv.Atoi(code); err == nil {
+			*sc = statusCode(n)
+		} else {
+			*sc = statusCode(httpStatusCode(code))
+		}
+	case nil:
+		*sc = 0
+	default:
+		return errors.New("invalid status " + string(data))
+	}
+
+	return nil
+}
+
+// UnmarshalJSON keeps strings as they are and stores any other JSON value (objects, arrays, etc.) verbatim
+func (mb *mockBody) UnmarshalJSON(data []byte) error {
+	var s string
+
+	if err := json.Unmarshal(data, &s); err == nil {
+		*mb = mockBody(s)
+		return nil
+	}
+
+	*mb = mockBody(data)
+	return nil
+}
+
+func parseMocks(data []byte) ([]*mockRule, error) {
+	log.Debug().Msg("entering parseMocks")
+	var raw interface{}
+
+	// JSON is a subset of YAML, so both formats go through the same decoder
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	var host string
+
+	if m, ok := raw.(map[string]interface{}); ok {
+		if mocks, found := m["mocks"]; found {
+			raw = mocks
+
+			// a host at the top level applies to every rule in the set
+			if h, found := m["host"]; found {
+				if host, ok = h.(string); !ok {
+					return nil, errors.New("host must be a string")
+				}
+			}
+		} else {
+			raw = []interface{}{m}
+		}
+	}
+
+	if raw == nil {
+		return nil, errors.New("no mocks found")
+	}
+
+	buf, err := json.Marshal(raw)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*mockRule
+
+	if err = json.Unmarshal(buf, &rules); err != nil {
+		return nil, err
+	}
+
+	for i, rule := range rules {
+		if rule == nil {
+			return nil, errors.New("mock #" + strconv.Itoa(i+1) + " is empty")
+		}
+
+		if rule.Host == "" {
+			rule.Host = host
+		}
+
+		if err = rule.validate(); err != nil {
+			return nil, errors.New("mock #" + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+	}
+
+	log.Debug().Msg("leaving parseMocks")
+	return rules, nil
+}
+
+func (rule *mockRule) validate() error {
+	if !strings.HasPrefix(rule.Path, "/") {
+		return errors.New("path must start with /")
+	}
+
+	if rule.Match != nil {
+		if err := rule.Match.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := rule.mockResponse.validate(); err != nil {
+		return err
+	}
+
+	for i := range rule.Responses {
+		if err := rule.Responses[i].validate(); err != nil {
+			return errors.New("response #" + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+	}
+
+	if rule.Scenario == "" && (rule.WhenState != "" || rule.NewState != "") {
+		return errors.New("whenState and newState require a scenario")
+	}
+
+	rule.Method = strings.ToUpper(rule.Method)
+	rule.Host = strings.ToLower(rule.Host)
+	return nil
+}
+
+func (rsp *mockResponse) validate() error {
+	if rsp.Status != 0 && (rsp.Status < 100 || rsp.Status > 599) {
+		return errors.New("invalid status " + strconv.Itoa(int(rsp.Status)))
+	}
+
+	if rsp.Delay < 0 {
+		return errors.New("delay cannot be negative")
+	}
+
+	if rsp.Throughput != "" {
+		if _, err := parseThroughput(rsp.Throughput); err != nil {
+			return err
+		}
+	}
+
+	if rsp.Latency != "" {
+		if _, err := parseLatency(rsp.Latency); err != nil {
+			return err
+		}
+	}
+
+	if rsp.FailureRate != "" {
+		if _, err := parseFailureRate(rsp.FailureRate); err != nil {
+			return err
+		}
+	}
+
+	if rsp.Fault = strings.ToLower(rsp.Fault); rsp.Fault != "" && !connectionFaults[rsp.Fault] {
+		return errors.New("unknown fault " + rsp.Fault)
+	}
+
+	return nil
+}
+
+func (srv *server) loadMocks(file string) error {
+	log.Debug().Msg("entering loadMocks")
+	data, err := os.ReadFile(file)
+
+	if err != nil {
+		return err
+	}
+
+	rules, err := parseMocks(data)
+
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		if rule.BodyFile != "" && srv.pth == "" {
+			log.Warn().Str("mock", rule.ID).Str("path", rule.Path).Msg("bodyFile " + rule.BodyFile + " requires the -path option")
+		}
+	}
+
+	if err = srv.mck.add(rules...); err != nil {
+		return err
+	}
+
+	log.Info().Str("file", file).Int("mocks", len(rules)).Msg("mocks loaded")
+	log.Debug().Msg("leaving loadMocks")
+	return nil
+}
+
+// add stores all rules or none of them
+func (ms *mockStore) add(rules ...*mockRule) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	ids := map[string]bool{}
+
+	for _, rule := range rules {
+		if rule.ID != "" && (ids[rule.ID] || ms.index(rule.ID) >= 0) {
+			return errors.New("mock " + rule.ID + " already exists")
+		}
+
+		ids[rule.ID] = true
+	}
+
+	for _, rule := range rules {
+		for rule.ID == "" {
+			ms.seq++
+
+			if id := "mock-" + strconv.Itoa(ms.seq); !ids[id] && ms.index(id) < 0 {
+				rule.ID = id
+			}
+		}
+
+		ms.rules = append(ms.rules, rule)
+	}
+
+	return nil
+}
+
+// index must be called with the lock held
+func (ms *mockStore) index(id string) int {
+	for i, rule := range ms.rules {
+		if rule.ID == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (ms *mockStore) list() []*mockRule {
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+
+	return append([]*mockRule{}, ms.rules...)
+}
+
+func (ms *mockStore) get(id string) *mockRule {
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+
+	if i := ms.index(id); i >= 0 {
+		return ms.rules[i]
+	}
+
+	return nil
+}
+
+func (ms *mockStore) replace(id string, rule *mockRule) bool {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	if i := ms.index(id); i >= 0 {
+		rule.ID = id
+		ms.rules[i] = rule
+		delete(ms.hits, id)
+		return true
+	}
+
+	return false
+}
+
+func (ms *mockStore) remove(id string) bool {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	if i := ms.index(id); i >= 0 {
+		ms.rules = append(ms.rules[:i], ms.rules[i+1:]...)
+		delete(ms.hits, id)
+		return true
+	}
+
+	return false
+}
+
+func (ms *mockStore) clear() {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	ms.rules = nil
+	ms.hits = nil
+	ms.states = nil
+}
+
+// reset moves the scenario back to its initial state and restarts response sequences.
+// An empty name resets every scenario and sequence
+func (ms *mockStore) reset(name string) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	if name == "" {
+		ms.hits = nil
+		ms.states = nil
+		return
+	}
+
+	delete(ms.states, name)
+
+	for _, rule := range ms.rules {
+		if rule.Scenario == name {
+			delete(ms.hits, rule.ID)
+		}
+	}
+}
+
+func (ms *mockStore) setState(name, state string) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	if ms.states == nil {
+		ms.states = map[string]string{}
+	}
+
+	ms.states[name] = state
+}
+
+// scenarios returns the current state of every known scenario
+func (ms *mockStore) scenarios() map[string]string {
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+	states := map[string]string{}
+
+	for _, rule := range ms.rules {
+		if rule.Scenario != "" {
+			states[rule.Scenario] = scenarioStarted
+		}
+	}
+
+	for name, state := range ms.states {
+		states[name] = state
+	}
+
+	return states
+}
+
+// state must be called with the lock held
+func (ms *mockStore) state(name string) string {
+	if state, ok := ms.states[name]; ok {
+		return state
+	}
+
+	return scenarioStarted
+}
+
+// needsBody tells whether any rule for the method, host and path of the request matches on its body
+func (ms *mockStore) needsBody(req *http.Request) bool {
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+
+	for _, rule := range ms.rules {
+		if !rule.Match.needsBody() || (rule.Method != "" && rule.Method != "*" && rule.Method != req.Method) {
+			continue
+		}
+
+		if rule.Host != "" && !matchHost(rule.Host, req.Host) {
+			continue
+		}
+
+		if _, ok := matchPath(rule.Path, req.URL.Path); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// match returns the highest priority rule matching the request, or the first one defined in case of a tie,
+// and the response it should serve, advancing the rule's response sequence and scenario state
+func (ms *mockStore) match(req *http.Request) (*mockRule, *mockResponse, map[string]string) {
+	if ms == nil {
+		return nil, nil, nil
+	}
+
+	var body interface{}
+	validBody := false
+
+	// the body is read without holding the lock, so slow clients don't hold back other requests
+	if ms.needsBody(req) {
+		body, validBody = jsonBody(req)
+	}
+
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	var best *mockRule
+	var bestParams map[string]string
+
+	for _, rule := range ms.rules {
+		if best != nil && rule.Priority <= best.Priority {
+			continue
+		}
+
+		if rule.Method != "" && rule.Method != "*" && rule.Method != req.Method {
+			continue
+		}
+
+		if rule.Host != "" && !matchHost(rule.Host, req.Host) {
+			continue
+		}
+
+		if rule.WhenState != "" && ms.state(rule.Scenario) != rule.WhenState {
+			continue
+		}
+
+		params, ok := matchPath(rule.Path, req.URL.Path)
+
+		if !ok {
+			continue
+		}
+
+		if rule.Match.matches(req, body, validBody) {
+			best, bestParams = rule, params
+		}
+	}
+
+	if best == nil {
+		return nil, nil, nil
+	}
+
+	return best, ms.fire(best), bestParams
+}
+
+// fire must be called with the lock held
+func (ms *mockStore) fire(rule *mockRule) *mockResponse {
+	if ms.hits == nil {
+		ms.hits = map[string]int{}
+	}
+
+	hit := ms.hits[rule.ID]
+	ms.hits[rule.ID]++
+
+	if rule.NewState != "" {
+		if ms.states == nil {
+			ms.states = map[string]string{}
+		}
+
+		ms.states[rule.Scenario] = rule.NewState
+	}
+
+	if len(rule.Responses) == 0 {
+		return &rule.mockResponse
+	}
+
+	if rule.Cycle {
+		return &rule.Responses[hit%len(rule.Responses)]
+	}
+
+	return &rule.Responses[min(hit, len(rule.Responses)-1)]
+}
+
+// matchPath compares a path against a pattern where {name} matches exactly one segment,
+// {name...} matches the remainder of the path and * matches any single segment
+func matchPath(pattern, path string) (map[string]string, bool) {
+	params := map[string]string{}
+	pat := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	seg := strings.Split(strings.TrimPrefix(path, "/"), "/")
+
+	for i, p := range pat {
+		if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "...}") {
+			params[strings.TrimSuffix(strings.TrimPrefix(p, "{"), "...}")] = strings.Join(seg[min(i, len(seg)):], "/")
+			return params, true
+		}
+
+		if i >= len(seg) {
+			return nil, false
+		}
+
+		switch {
+		case p == "*":
+		case strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}"):
+			if seg[i] == "" {
+				return nil, false
+			}
+
+			params[strings.TrimSuffix(strings.TrimPrefix(p, "{"), "}")] = seg[i]
+		case p != seg[i]:
+			return nil, false
+		}
+	}
+
+	if len(pat) != len(seg) {
+		return nil, false
+	}
+
+	return params, true
+}
+
+// matchHost compares the request's host, ignoring its port, against a pattern where *.example.com
+// matches any subdomain of example.com
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		// IPv6 addresses without a port keep their brackets
+		host = host[1 : len(host)-1]
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+
+	return host == pattern
+}
+
+func (srv *server) handleMocks(next http.HandlerFunc) http.HandlerFunc {
+	log.Debug().Msg("entering handleMocks")
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		rule, rsp, params := srv.mck.match(req)
+
+		if rule == nil {
+			next(res, req)
+			return
+		}
+
+		log.Info().
+			Str("protocol", req.Proto).
+			Str("remoteAddress", req.RemoteAddr).
+			Str("method", req.Method).
+			Str("host", req.Host).
+			Str("path", req.RequestURI).
+			Str("mock", rule.ID).
+			Msg("handleMocks")
+
+		if entry := requestEntry(req); entry != nil {
+			entry.Mock = rule.ID
+		}
+
+		srv.serveRule(res, req, rule.ID, rsp, params)
+		log.Debug().Msg("leaving handleMocks")
+	}
+}
+
+func (srv *server) serveRule(res http.ResponseWriter, req *http.Request, id string, rsp *mockResponse, params map[string]string) {
+	log.Debug().Msg("entering serveRule")
+
+	if rsp.Fault != "" {
+		setFault(req, rsp.Fault)
+	}
+
+	encoding, mime, contentEncoding := mimeType(rsp.ContentType)
+	res.Header().Set("Content-Type", mime)
+
+	if contentEncoding != "" {
+		res.Header().Set("Content-Encoding", contentEncoding)
+	}
+
+	for k, v := range rsp.Headers {
+		res.Header().Set(k, fmt.Sprintf("%v", v))
+	}
+
+	status := int(rsp.Status)
+
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	data := string(rsp.Body)
+
+	if rsp.BodyFile != "" {
+		if srv.pth == "" {
+			log.Error().Str("mock", id).Msg("bodyFile " + rsp.BodyFile + " requires the -path option")
+			data, status = "", http.StatusNotFound
+		} else if ct, st := srv.responseFile(rsp.BodyFile); st != http.StatusOK {
+			data, status = "", st
+		} else {
+			data = ct
+		}
+	}
+
+	if rsp.Template && data != "" {
+		if out, err := render(data, req, params); err != nil {
+			log.Error().Str("mock", id).Msg("Unable to render template: " + err.Error())
+			data, status = "", http.StatusInternalServerError
+		} else {
+			data = out
+		}
+	}
+
+	// the latency, failure rate and throughput have been validated when the mock was loaded
+	delay, fr, _ := srv.chaos(rsp.Latency, rsp.FailureRate)
+	delay += time.Duration(rsp.Delay) * time.Millisecond
+
+	if fr != nil && fr.fails(srv.rnd) {
+		log.Warn().Str("mock", id).Int("status", fr.status).Msg("Failing response")
+		res.Header().Del("Content-Encoding")
+		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		encoding, status, data = encodingTEXT, fr.status, http.StatusText(fr.status)
+	}
+
+	if encoding == encodingSSE && status < 300 {
+		if events, err := parseEvents(data); err != nil {
+			log.Error().Str("mock", id).Msg(err.Error())
+			http.Error(res, "Internal Server Error", http.StatusInternalServerError)
+		} else {
+			srv.stream(res, req, status, delay, events)
+		}
+
+		log.Debug().Msg("leaving serveRule")
+		return
+	}
+
+	rw, _ := srv.throttle(res, req, rsp.Throughput)
+	rw.WriteHeader(status)
+	srv.respond(rw, encoding, delay, data)
+	log.Debug().Msg("leaving serveRule")
+}
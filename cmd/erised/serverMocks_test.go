@@ -0,0 +1,342 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+)
+
+func TestErisedMocks(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	svr := server{pth: ".", mck: &mockStore{}}
+
+	g.Describe("Test mock definitions", func() {
+		g.It("Should load serverMocks_test.yaml", func() {
+			Ω(svr.loadMocks("serverMocks_test.yaml")).Should(Succeed())
+			Ω(svr.mck.rules).Should(HaveLen(3))
+			Ω(svr.mck.rules[1].ID).Should(Equal("mock-1"))
+		})
+
+		g.It("Should fail to load a missing file", func() {
+			Ω(svr.loadMocks("|file/:/cannot/:/exist|")).ShouldNot(Succeed())
+		})
+
+		g.It("Should reject invalid mocks", func() {
+			_, err := parseMocks([]byte(`[{"path":"no/slash"}]`))
+			Ω(err).Should(HaveOccurred())
+
+			_, err = parseMocks([]byte(`[{"path":"/","status":999}]`))
+			Ω(err).Should(HaveOccurred())
+		})
+
+		g.It("Should accept a JSON list of mocks", func() {
+			rules, err := parseMocks([]byte(`[{"method":"get","path":"/a","status":"NotFound"}]`))
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(rules[0].Method).Should(Equal("GET"))
+			Ω(int(rules[0].Status)).Should(Equal(http.StatusNotFound))
+		})
+
+		g.It("Should return the matching mock", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/jokes/random", nil)
+			svr.handleMocks(svr.handleLanding()).ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(res.Header().Get("Content-Type")).Should(Equal("application/json"))
+			Ω(res.Header().Get("X-Powered-By")).Should(Equal("erised"))
+			Ω(res.Body.String()).Should(Equal(`{"value":"The lord giveth and Chuck Norris taketh away"}`))
+		})
+
+		g.It("Should match path parameters and method", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/jokes/42", nil)
+			svr.handleMocks(svr.handleLanding()).ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusCreated))
+			Ω(res.Body.String()).Should(Equal(`{"created":true}`))
+		})
+
+		g.It("Should return bodyFile content", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/files/any/thing", nil)
+			svr.handleMocks(svr.handleLanding()).ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(res.Body.String()).Should(Equal(`{"Name":"serverRoutes_test"}` + "\n"))
+		})
+
+		g.It("Should fall back to X-Erised headers", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodDelete, "http://localhost:8080/jokes/42", nil)
+			req.Header.Set("X-Erised-Status-Code", "Teapot")
+			svr.handleMocks(svr.handleLanding()).ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusTeapot))
+		})
+	})
+
+	g.Describe("Test path patterns", func() {
+		g.It("Should match patterns", func() {
+			p, ok := matchPath("/users/{id}/orders/*", "/users/7/orders/9")
+			Ω(ok).Should(BeTrue())
+			Ω(p).Should(HaveKeyWithValue("id", "7"))
+
+			p, ok = matchPath("/static/{file...}", "/static/css/site.css")
+			Ω(ok).Should(BeTrue())
+			Ω(p).Should(HaveKeyWithValue("file", "css/site.css"))
+
+			_, ok = matchPath("/users/{id}", "/users/7/orders")
+			Ω(ok).Should(BeFalse())
+
+			_, ok = matchPath("/users/{id}", "/users/")
+			Ω(ok).Should(BeFalse())
+		})
+
+		g.It("Should match hosts", func() {
+			Ω(matchHost("payments.test", "payments.test")).Should(BeTrue())
+			Ω(matchHost("payments.test", "Payments.Test:8443")).Should(BeTrue())
+			Ω(matchHost("*.example.test", "eu.api.example.test")).Should(BeTrue())
+			Ω(matchHost("*.example.test", "example.test")).Should(BeFalse())
+			Ω(matchHost("payments.test", "identity.test")).Should(BeFalse())
+		})
+	})
+
+	g.Describe("Test virtual hosts", func() {
+		vhs := server{mck: &mockStore{}}
+		get := func(host string) *httptest.ResponseRecorder {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "https://"+host+"/v1/status", nil)
+			vhs.handleMocks(vhs.handleLanding()).ServeHTTP(res, req)
+			return res
+		}
+
+		g.It("Should apply the host of a mock set to its rules", func() {
+			rules, err := parseMocks([]byte("host: Payments.Test\nmocks:\n  - path: /v1/status\n    body: payments\n  - host: identity.test\n    path: /v1/status\n    body: identity\n"))
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(rules[0].Host).Should(Equal("payments.test"))
+			Ω(rules[1].Host).Should(Equal("identity.test"))
+			Ω(vhs.mck.add(rules...)).Should(Succeed())
+
+			_, err = parseMocks([]byte("host: [a, b]\nmocks:\n  - path: /\n"))
+			Ω(err).Should(HaveOccurred())
+		})
+
+		g.It("Should route requests by host", func() {
+			Ω(vhs.mck.add(&mockRule{Path: "/v1/status", mockResponse: mockResponse{Body: "any"}})).Should(Succeed())
+
+			Ω(get("payments.test:8443").Body.String()).Should(Equal("payments"))
+			Ω(get("identity.test").Body.String()).Should(Equal("identity"))
+			Ω(get("storage.test").Body.String()).Should(Equal("any"))
+		})
+
+		g.It("Should route IPv6 hosts with or without a port", func() {
+			Ω(vhs.mck.add(&mockRule{Host: "::1", Path: "/v1/status", Priority: 1, mockResponse: mockResponse{Body: "loopback"}})).Should(Succeed())
+
+			Ω(get("[::1]").Body.String()).Should(Equal("loopback"))
+			Ω(get("[::1]:8443").Body.String()).Should(Equal("loopback"))
+		})
+	})
+}
+
+func TestErisedMocksRoute(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	svr := server{mck: &mockStore{}}
+
+	g.Describe("Test erised/mocks", func() {
+		g.It("Should create mocks", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/erised/mocks", strings.NewReader(`{"id":"teapot","path":"/brew","status":418}`))
+			svr.handleMocksAPI().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusCreated))
+			Ω(res.Body.String()).Should(Equal(`[{"id":"teapot","path":"/brew","status":418}]`))
+		})
+
+		g.It("Should return Conflict for duplicated ids", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/erised/mocks", strings.NewReader(`{"id":"teapot","path":"/brew"}`))
+			svr.handleMocksAPI().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusConflict))
+		})
+
+		g.It("Should return BadRequest for invalid mocks", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/erised/mocks", strings.NewReader(`{"path":"brew"}`))
+			svr.handleMocksAPI().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusBadRequest))
+		})
+
+		g.It("Should serve the new mock", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/brew", nil)
+			svr.handleMocks(svr.handleLanding()).ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusTeapot))
+		})
+
+		g.It("Should list and fetch mocks", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/erised/mocks", nil)
+			svr.handleMocksAPI().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(res.Body.String()).Should(ContainSubstring(`"id":"teapot"`))
+
+			res = httptest.NewRecorder()
+			req = httptest.NewRequest(http.MethodGet, "http://localhost:8080/erised/mocks/teapot", nil)
+			req.SetPathValue("id", "teapot")
+			svr.handleMocksAPI().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(res.Body.String()).Should(Equal(`{"id":"teapot","path":"/brew","status":418}`))
+		})
+
+		g.It("Should update mocks", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPut, "http://localhost:8080/erised/mocks/teapot", strings.NewReader(`{"path":"/brew","status":"ServiceUnavailable"}`))
+			req.SetPathValue("id", "teapot")
+			svr.handleMocksAPI().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+
+			res = httptest.NewRecorder()
+			req = httptest.NewRequest(http.MethodGet, "http://localhost:8080/brew", nil)
+			svr.handleMocks(svr.handleLanding()).ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusServiceUnavailable))
+		})
+
+		g.It("Should delete mocks", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodDelete, "http://localhost:8080/erised/mocks/teapot", nil)
+			req.SetPathValue("id", "teapot")
+			svr.handleMocksAPI().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusNoContent))
+
+			res = httptest.NewRecorder()
+			req = httptest.NewRequest(http.MethodGet, "http://localhost:8080/erised/mocks/teapot", nil)
+			req.SetPathValue("id", "teapot")
+			svr.handleMocksAPI().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusNotFound))
+		})
+
+		g.It("Should return MethodNotAllowed", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPatch, "http://localhost:8080/erised/mocks", nil)
+			svr.handleMocksAPI().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusMethodNotAllowed))
+		})
+	})
+}
+
+func TestErisedScenarios(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	svr := server{mck: &mockStore{}}
+	rules, _ := parseMocks([]byte(`
+- id: retry
+  path: /retry
+  responses:
+    - status: ServiceUnavailable
+    - status: ServiceUnavailable
+    - status: OK
+      body: done
+- path: /cycle
+  cycle: true
+  responses:
+    - body: tick
+    - body: tock
+- path: /cart
+  method: GET
+  scenario: cart
+  whenState: Started
+  body: empty
+- path: /cart
+  method: POST
+  scenario: cart
+  newState: Filled
+  status: 201
+- path: /cart
+  method: GET
+  scenario: cart
+  whenState: Filled
+  body: one item
+`))
+	_ = svr.mck.add(rules...)
+	hnd := svr.handleMocks(svr.handleLanding())
+	call := func(method, path string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		hnd.ServeHTTP(res, httptest.NewRequest(method, "http://localhost:8080"+path, nil))
+		return res
+	}
+
+	g.Describe("Test stateful scenarios", func() {
+		g.It("Should return responses in sequence and repeat the last one", func() {
+			Ω(call(http.MethodGet, "/retry")).Should(HaveHTTPStatus(http.StatusServiceUnavailable))
+			Ω(call(http.MethodGet, "/retry")).Should(HaveHTTPStatus(http.StatusServiceUnavailable))
+			Ω(call(http.MethodGet, "/retry").Body.String()).Should(Equal("done"))
+			Ω(call(http.MethodGet, "/retry")).Should(HaveHTTPStatus(http.StatusOK))
+		})
+
+		g.It("Should cycle through responses", func() {
+			Ω(call(http.MethodGet, "/cycle").Body.String()).Should(Equal("tick"))
+			Ω(call(http.MethodGet, "/cycle").Body.String()).Should(Equal("tock"))
+			Ω(call(http.MethodGet, "/cycle").Body.String()).Should(Equal("tick"))
+		})
+
+		g.It("Should move scenarios between states", func() {
+			Ω(call(http.MethodGet, "/cart").Body.String()).Should(Equal("empty"))
+			Ω(call(http.MethodPost, "/cart")).Should(HaveHTTPStatus(http.StatusCreated))
+			Ω(call(http.MethodGet, "/cart").Body.String()).Should(Equal("one item"))
+			Ω(svr.mck.scenarios()).Should(HaveKeyWithValue("cart", "Filled"))
+		})
+
+		g.It("Should reset scenarios", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodDelete, "http://localhost:8080/erised/scenarios", nil)
+			svr.handleScenarios().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusNoContent))
+			Ω(call(http.MethodGet, "/cart").Body.String()).Should(Equal("empty"))
+			Ω(call(http.MethodGet, "/retry")).Should(HaveHTTPStatus(http.StatusServiceUnavailable))
+		})
+
+		g.It("Should set scenario states", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPut, "http://localhost:8080/erised/scenarios/cart", strings.NewReader(`{"state":"Filled"}`))
+			req.SetPathValue("name", "cart")
+			svr.handleScenarios().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusNoContent))
+			Ω(call(http.MethodGet, "/cart").Body.String()).Should(Equal("one item"))
+
+			res = httptest.NewRecorder()
+			req = httptest.NewRequest(http.MethodGet, "http://localhost:8080/erised/scenarios", nil)
+			svr.handleScenarios().ServeHTTP(res, req)
+
+			Ω(res.Body.String()).Should(Equal(`{"cart":"Filled"}`))
+		})
+
+		g.It("Should reject states without scenario", func() {
+			_, err := parseMocks([]byte(`{"path":"/","newState":"x"}`))
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/legacy"
+	"github.com/rs/zerolog/log"
+)
+
+// maximum nesting when generating samples, which also stops recursive schemas
+const sampleDepth = 8
+
+const (
+	validationStrict  = "strict"
+	validationLenient = "lenient"
+	validationOff     = "off"
+)
+
+type openAPIMock struct {
+	doc        *openapi3.T
+	router     routers.Router
+	validation string
+}
+
+func (srv *server) loadOpenAPI(file, validation string) error {
+	log.Debug().Msg("entering loadOpenAPI")
+	loader := openapi3.NewLoader()
+	loader.IsExternalRefsAllowed = true
+	doc, err := loader.LoadFromFile(file)
+
+	if err != nil {
+		return err
+	}
+
+	if err = doc.Validate(context.Background(), openapi3.DisableExamplesValidation()); err != nil {
+		return err
+	}
+
+	// serve the spec under the servers' base paths, regardless of their scheme and host
+	servers := openapi3.Servers{}
+
+	for _, s := range doc.Servers {
+		bp, err := s.BasePath()
+
+		if err != nil {
+			return err
+		}
+
+		servers = append(servers, &openapi3.Server{URL: bp})
+	}
+
+	doc.Servers = servers
+	router, err := legacy.NewRouter(doc)
+
+	if err != nil {
+		return err
+	}
+
+	switch validation {
+	case validationStrict, validationLenient, validationOff:
+	default:
+		return errors.New("invalid validation mode " + validation)
+	}
+
+	srv.oas = &openAPIMock{doc: doc, router: router, validation: validation}
+	log.Info().
+		Str("file", file).
+		Str("title", doc.Info.Title).
+		Int("paths", doc.Paths.Len()).
+		Str("validation", validation).
+		Msg("OpenAPI spec loaded")
+	log.Debug().Msg("leaving loadOpenAPI")
+	return nil
+}
+
+func (srv *server) handleOpenAPI(next http.HandlerFunc) http.HandlerFunc {
+	log.Debug().Msg("entering handleOpenAPI")
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		if srv.oas == nil {
+			next(res, req)
+			return
+		}
+
+		route, _, err := srv.oas.findRoute(req)
+
+		if err != nil {
+			log.Debug().Msg("No OpenAPI operation for " + req.Method + " " + req.URL.Path + ": " + err.Error())
+			next(res, req)
+			return
+		}
+
+		log.Info().
+			Str("protocol", req.Proto).
+			Str("remoteAddress", req.RemoteAddr).
+			Str("method", req.Method).
+			Str("host", req.Host).
+			Str("path", req.RequestURI).
+			Str("operation", route.Method+" "+route.Path).
+			Msg("handleOpenAPI")
+
+		if entry := requestEntry(req); entry != nil {
+			entry.Mock = "openapi:" + route.Method + " " + route.Path
+		}
+
+		status, rsp := selectResponse(route.Operation, req.Header.Get("X-Erised-Status-Code"))
+		delay := time.Duration(0)
+
+		if xrd, err := strconv.Atoi(req.Header.Get("X-Erised-Response-Delay")); xrd > 0 && err == nil {
+			delay = time.Duration(xrd) * time.Millisecond
+		}
+
+		rw, err := srv.throttle(res, req, req.Header.Get("X-Erised-Throughput"))
+
+		if err != nil {
+			http.Error(res, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		data := ""
+
+		if rsp != nil {
+			if mime, media := selectContent(rsp.Content); media != nil {
+				rw.Header().Set("Content-Type", mime)
+				data = mediaSample(mime, media)
+			}
+		}
+
+		rw.WriteHeader(status)
+		srv.respond(rw, encodingTEXT, delay, data)
+		log.Debug().Msg("leaving handleOpenAPI")
+	}
+}
+
+func (srv *server) handleValidation(next http.HandlerFunc) http.HandlerFunc {
+	log.Debug().Msg("entering handleValidation")
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		if srv.oas == nil || srv.oas.validation == validationOff {
+			next(res, req)
+			return
+		}
+
+		violations, ok := srv.oas.validate(req)
+
+		if !ok {
+			next(res, req)
+			return
+		}
+
+		if len(violations) == 0 {
+			res.Header().Set("X-Erised-Validation", "passed")
+			next(res, req)
+			return
+		}
+
+		log.Warn().
+			Str("method", req.Method).
+			Str("path", req.RequestURI).
+			Strs("violations", violations).
+			Msg("request validation failed")
+
+		if entry := requestEntry(req); entry != nil {
+			entry.Violations = violations
+		}
+
+		if srv.oas.validation == validationLenient {
+			res.Header().Set("X-Erised-Validation", "failed: "+strings.Join(violations, "; "))
+			next(res, req)
+			return
+		}
+
+		data, _ := json.Marshal(map[string]interface{}{
+			"type":       "about:blank",
+			"title":      "Request validation failed",
+			"status":     http.StatusBadRequest,
+			"detail":     "The request does not conform to the OpenAPI contract",
+			"violations": violations,
+		})
+		res.Header().Set("Content-Type", "application/problem+json")
+		res.Header().Set("X-Erised-Validation", "failed")
+		res.WriteHeader(http.StatusBadRequest)
+		srv.respond(res, encodingJSON, 0, string(data))
+		log.Debug().Msg("leaving handleValidation")
+	}
+}
+
+// validate checks the request against its operation and returns the violations found.
+// It returns false when the request does not match any operation in the spec
+func (oas *openAPIMock) validate(req *http.Request) ([]string, bool) {
+	route, params, err := oas.findRoute(req)
+
+	if err != nil {
+		return nil, false
+	}
+
+	body, err := io.ReadAll(req.Body)
+
+	if err != nil {
+		return []string{"unable to read request body: " + err.Error()}, true
+	}
+
+	u := *req.URL
+	u.Scheme, u.Host = "", ""
+	r := req.Clone(req.Context())
+	r.URL = &u
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	err = openapi3filter.ValidateRequest(req.Context(), &openapi3filter.RequestValidationInput{
+		Request:    r,
+		PathParams: params,
+		Route:      route,
+		Options: &openapi3filter.Options{
+			MultiError:          true,
+			AuthenticationFunc:  openapi3filter.NoopAuthenticationFunc,
+			SkipSettingDefaults: true,
+		},
+	})
+
+	return violations(err), true
+}
+
+func violations(err error) []string {
+	var me openapi3.MultiError
+
+	if err == nil {
+		return nil
+	}
+
+	if !errors.As(err, &me) {
+		// drop the schema and value dumps appended to schema errors
+		return []string{strings.TrimSpace(strings.SplitN(err.Error(), "\nSchema:", 2)[0])}
+	}
+
+	msgs := make([]string, 0, len(me))
+
+	for _, e := range me {
+		msgs = append(msgs, violations(e)...)
+	}
+
+	return msgs
+}
+
+// findRoute ignores the scheme and host of absolute request URLs, as only base paths are kept from the servers
+func (oas *openAPIMock) findRoute(req *http.Request) (*routers.Route, map[string]string, error) {
+	u := *req.URL
+	u.Scheme, u.Host = "", ""
+	r := req.WithContext(req.Context())
+	r.URL = &u
+
+	return oas.router.FindRoute(r)
+}
+
+// selectResponse returns the response documented for the X-Erised-Status-Code value, when present,
+// or the first documented success response otherwise
+func selectResponse(op *openapi3.Operation, xStatusCode string) (int, *openapi3.Response) {
+	if op.Responses == nil {
+		return http.StatusOK, nil
+	}
+
+	if xStatusCode != "" {
+		status := httpStatusCode(xStatusCode)
+
+		if n, err := strconv.Atoi(xStatusCode); err == nil && n >= 100 && n <= 599 {
+			status = n
+		}
+
+		if ref := op.Responses.Status(status); ref != nil {
+			return status, ref.Value
+		}
+
+		if ref := op.Responses.Default(); ref != nil {
+			return status, ref.Value
+		}
+	}
+
+	codes := make([]string, 0, op.Responses.Len())
+
+	for code := range op.Responses.Map() {
+		codes = append(codes, code)
+	}
+
+	sort.Strings(codes)
+
+	for _, code := range codes {
+		if n := responseCode(code); n >= 200 && n < 300 {
+			return n, op.Responses.Value(code).Value
+		}
+	}
+
+	if ref := op.Responses.Default(); ref != nil {
+		return http.StatusOK, ref.Value
+	}
+
+	for _, code := range codes {
+		if n := responseCode(code); n != 0 {
+			return n, op.Responses.Value(code).Value
+		}
+	}
+
+	return http.StatusOK, nil
+}
+
+// responseCode converts response keys such as 404 or 4XX to a status code, returning 0 for default
+func responseCode(code string) int {
+	n, err := strconv.Atoi(strings.ReplaceAll(strings.ToUpper(code), "XX", "00"))
+
+	if err != nil {
+		return 0
+	}
+
+	return n
+}
+
+// selectContent prefers JSON content, otherwise the first media type in alphabetical order
+func selectContent(content openapi3.Content) (string, *openapi3.MediaType) {
+	if len(content) == 0 {
+		return "", nil
+	}
+
+	mimes := make([]string, 0, len(content))
+
+	for mime := range content {
+		mimes = append(mimes, mime)
+	}
+
+	sort.Strings(mimes)
+
+	for _, mime := range mimes {
+		if strings.Contains(mime, "json") {
+			return mime, content[mime]
+		}
+	}
+
+	return mimes[0], content[mimes[0]]
+}
+
+// mediaSample returns the documented example or a sample generated from the schema
+func mediaSample(mime string, media *openapi3.MediaType) string {
+	var sample interface{}
+
+	switch {
+	case media.Example != nil:
+		sample = media.Example
+	case len(media.Examples) > 0:
+		names := make([]string, 0, len(media.Examples))
+
+		for name := range media.Examples {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		if ex := media.Examples[names[0]]; ex != nil && ex.Value != nil {
+			sample = ex.Value.Value
+		}
+	case media.Schema != nil:
+		sample = schemaSample(media.Schema, 0)
+	}
+
+	if s, ok := sample.(string); ok && !strings.Contains(mime, "json") {
+		return s
+	}
+
+	if sample == nil {
+		return ""
+	}
+
+	data, err := json.Marshal(sample)
+
+	if err != nil {
+		log.Error().Msg("Unable to encode sample: " + err.Error())
+		return ""
+	}
+
+	return string(data)
+}
+
+func schemaSample(ref *openapi3.SchemaRef, depth int) interface{} {
+	if ref == nil || ref.Value == nil || depth > sampleDepth {
+		return nil
+	}
+
+	schema := ref.Value
+
+	switch {
+	case schema.Example != nil:
+		return schema.Example
+	case schema.Default != nil:
+		return schema.Default
+	case len(schema.Enum) > 0:
+		return schema.Enum[0]
+	case len(schema.AllOf) > 0:
+		merged := map[string]interface{}{}
+
+		for _, s := range schema.AllOf {
+			if obj, ok := schemaSample(s, depth+1).(map[string]interface{}); ok {
+				for k, v := range obj {
+					merged[k] = v
+				}
+			}
+		}
+
+		return merged
+	case len(schema.OneOf) > 0:
+		return schemaSample(schema.OneOf[0], depth+1)
+	case len(schema.AnyOf) > 0:
+		return schemaSample(schema.AnyOf[0], depth+1)
+	}
+
+	switch {
+	case schema.Type.Includes("object") || schema.Type == nil && len(schema.Properties) > 0:
+		obj := map[string]interface{}{}
+
+		for name, prop := range schema.Properties {
+			if v := schemaSample(prop, depth+1); v != nil {
+				obj[name] = v
+			}
+		}
+
+		return obj
+	case schema.Type.Includes("array"):
+		if item := schemaSample(schema.Items, depth+1); item != nil {
+			return []interface{}{item}
+		}
+
+		return []interface{}{}
+	case schema.Type.Includes("integer"):
+		if schema.Min != nil {
+			return int64(*schema.Min)
+		}
+
+		return 0
+	case schema.Type.Includes("number"):
+		if schema.Min != nil {
+			return *schema.Min
+		}
+
+		return 0.0
+	case schema.Type.Includes("boolean"):
+		return true
+	case schema.Type.Includes("string"):
+		return stringSample(schema.Format)
+	default:
+		return nil
+	}
+}
+
+func stringSample(format string) string {
+	switch format {
+	case "date":
+		return "2020-12-30"
+	case "date-time":
+		return "2020-12-30T11:21:32Z"
+	case "time":
+		return "11:21:32"
+	case "email":
+		return "user@example.com"
+	case "uuid":
+		return "3fa85f64-5717-4562-b3fc-2c963f66afa6"
+	case "uri", "url":
+		return "https://www.example.com"
+	case "hostname":
+		return "www.example.com"
+	case "ipv4":
+		return "192.0.2.1"
+	case "ipv6":
+		return "2001:db8::1"
+	case "byte":
+		return "ZXJpc2Vk"
+	default:
+		return "string"
+	}
+}
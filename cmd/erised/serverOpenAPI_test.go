@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+)
+
+func TestErisedOpenAPI(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	svr := server{}
+
+	g.Describe("Test OpenAPI mocks", func() {
+		g.It("Should load serverOpenAPI_test.yaml", func() {
+			Ω(svr.loadOpenAPI("serverOpenAPI_test.yaml", validationOff)).Should(Succeed())
+		})
+
+		g.It("Should fail to load invalid specs", func() {
+			Ω(svr.loadOpenAPI("serverMocks_test.yaml", validationOff)).ShouldNot(Succeed())
+		})
+
+		g.It("Should return the documented example", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/v1/jokes/random", nil)
+			svr.handleOpenAPI(svr.handleLanding()).ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(res.Header().Get("Content-Type")).Should(Equal("application/json"))
+			Ω(res.Body.String()).Should(Equal(`{"value":"The lord giveth and Chuck Norris taketh away"}`))
+		})
+
+		g.It("Should return a schema generated sample", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/v1/jokes/42", nil)
+			svr.handleOpenAPI(svr.handleLanding()).ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(res.Body.String()).Should(MatchJSON(`{"id":"3fa85f64-5717-4562-b3fc-2c963f66afa6","categories":["dev"],"rating":1}`))
+		})
+
+		g.It("Should select the response with X-Erised-Status-Code", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/v1/jokes/random", nil)
+			req.Header.Set("X-Erised-Status-Code", "NotFound")
+			svr.handleOpenAPI(svr.handleLanding()).ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusNotFound))
+			Ω(res.Body.String()).Should(MatchJSON(`{"status":404,"message":"string"}`))
+		})
+
+		g.It("Should fall back for undocumented operations", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/v1/jokes/random", nil)
+			req.Header.Set("X-Erised-Status-Code", "Teapot")
+			svr.handleOpenAPI(svr.handleLanding()).ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusTeapot))
+		})
+	})
+}
+
+func TestErisedValidation(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	strict := server{jnl: newJournal(10)}
+	lenient := server{}
+	_ = strict.loadOpenAPI("serverOpenAPI_test.yaml", validationStrict)
+	_ = lenient.loadOpenAPI("serverOpenAPI_test.yaml", validationLenient)
+	valid := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/v1/jokes", strings.NewReader(`{"categories":["dev"],"rating":5}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Request-Id", "42")
+		return req
+	}
+	invalid := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/v1/jokes", strings.NewReader(`{"rating":"five"}`))
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+
+	g.Describe("Test OpenAPI validation", func() {
+		g.It("Should reject invalid validation modes", func() {
+			Ω(lenient.loadOpenAPI("serverOpenAPI_test.yaml", "loose")).ShouldNot(Succeed())
+		})
+
+		g.It("Should accept valid requests", func() {
+			res := httptest.NewRecorder()
+			strict.handleValidation(strict.handleOpenAPI(strict.handleLanding())).ServeHTTP(res, valid())
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusCreated))
+			Ω(res.Header().Get("X-Erised-Validation")).Should(Equal("passed"))
+		})
+
+		g.It("Should return BadRequest with the violations", func() {
+			res := httptest.NewRecorder()
+			strict.handleJournal(strict.handleValidation(strict.handleOpenAPI(strict.handleLanding()))).ServeHTTP(res, invalid())
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusBadRequest))
+			Ω(res.Header().Get("Content-Type")).Should(Equal("application/problem+json"))
+			Ω(res.Body.String()).Should(ContainSubstring(`X-Request-Id`))
+			Ω(res.Body.String()).Should(ContainSubstring(`categories`))
+			Ω(strict.jnl.list(journalFilter{})[0].Violations).Should(ConsistOf(
+				ContainSubstring(`"X-Request-Id" in header`),
+				ContainSubstring(`"/rating": value must be an integer`),
+				ContainSubstring(`property "categories" is missing`),
+			))
+		})
+
+		g.It("Should serve the response and report violations in lenient mode", func() {
+			res := httptest.NewRecorder()
+			lenient.handleValidation(lenient.handleOpenAPI(lenient.handleLanding())).ServeHTTP(res, invalid())
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusCreated))
+			Ω(res.Header().Get("X-Erised-Validation")).Should(HavePrefix("failed: "))
+		})
+
+		g.It("Should not validate requests outside the spec", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/other", nil)
+			strict.handleValidation(strict.handleOpenAPI(strict.handleLanding())).ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(res.Header().Get("X-Erised-Validation")).Should(BeEmpty())
+		})
+	})
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// outage fails every request served under / between start and end, measured from when it is set.
+// When healthy or unhealthy are set, the service flaps between both states within the window,
+// starting healthy
+type outage struct {
+	Name      string     `json:"name"`
+	Start     string     `json:"start,omitempty"`
+	End       string     `json:"end,omitempty"`
+	Healthy   string     `json:"healthy,omitempty"`
+	Unhealthy string     `json:"unhealthy,omitempty"`
+	Status    statusCode `json:"status,omitempty"`
+	From      time.Time  `json:"from"`
+	Until     *time.Time `json:"until,omitempty"`
+	healthy   time.Duration
+	unhealthy time.Duration
+}
+
+type outageStore struct {
+	mtx     sync.RWMutex
+	outages []*outage
+	seq     int
+}
+
+// parseOutage reads the compact form of an outage: start-end for a window, e.g. 30s-90s or 30s- for
+// one that never ends, or flap:period and flap:healthy/unhealthy for flapping. Either can end with
+// :status, 503 otherwise
+func parseOutage(spec string) (*outage, error) {
+	spec = strings.TrimSpace(spec)
+	o := &outage{}
+
+	if strings.HasPrefix(strings.ToLower(spec), "flap:") {
+		period, status, _ := strings.Cut(spec[len("flap:"):], ":")
+		o.Healthy, o.Unhealthy, _ = strings.Cut(period, "/")
+		o.Status = outageStatus(status)
+		return o, nil
+	}
+
+	window, status, _ := strings.Cut(spec, ":")
+	start, end, found := strings.Cut(window, "-")
+
+	if !found {
+		return nil, errors.New("invalid outage " + spec + ", use start-end, flap:period or flap:healthy/unhealthy")
+	}
+
+	o.Start, o.End, o.Status = strings.TrimSpace(start), strings.TrimSpace(end), outageStatus(status)
+	return o, nil
+}
+
+// outageStatus reads a status code or name. Invalid values are left for schedule to reject
+func outageStatus(status string) statusCode {
+	if status = strings.TrimSpace(status); status == "" {
+		return 0
+	}
+
+	if n, err := strconv.Atoi(status); err == nil {
+		return statusCode(n)
+	}
+
+	if code := httpStatusCode(status); code != http.StatusOK {
+		return statusCode(code)
+	}
+
+	return -1
+}
+
+// parseOutages reads an outage, or a list of them, in YAML or JSON, scheduled from now. Strings are read
+// in the compact form
+func parseOutages(data []byte, now time.Time) ([]*outage, error) {
+	var raw interface{}
+
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	items, ok := raw.([]interface{})
+
+	if !ok {
+		items = []interface{}{raw}
+	}
+
+	if raw == nil || len(items) == 0 {
+		return nil, errors.New("no outages found")
+	}
+
+	outages := make([]*outage, 0, len(items))
+
+	for i, item := range items {
+		if spec, ok := item.(string); ok {
+			o, err := parseOutage(spec)
+
+			if err == nil {
+				err = o.schedule(now)
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			outages = append(outages, o)
+			continue
+		}
+
+		buf, err := json.Marshal(item)
+
+		if err != nil {
+			return nil, err
+		}
+
+		o := &outage{}
+
+		if err = json.Unmarshal(buf, o); err == nil {
+			err = o.schedule(now)
+		}
+
+		if err != nil {
+			return nil, errors.New("outage #" + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+
+		outages = append(outages, o)
+	}
+
+	return outages, nil
+}
+
+// schedule validates the outage and sets its window, starting from now
+func (o *outage) schedule(now time.Time) error {
+	durations := map[string]time.Duration{}
+
+	for field, value := range map[string]string{"start": o.Start, "end": o.End, "healthy": o.Healthy, "unhealthy": o.Unhealthy} {
+		if value == "" {
+			continue
+		}
+
+		d, err := time.ParseDuration(value)
+
+		if err != nil || d < 0 {
+			return errors.New("invalid " + field + " " + value)
+		}
+
+		durations[field] = d
+	}
+
+	o.From = now.Add(durations["start"])
+	o.Until = nil
+
+	if o.End != "" {
+		if durations["end"] <= durations["start"] {
+			return errors.New("end must be after start")
+		}
+
+		until := now.Add(durations["end"])
+		o.Until = &until
+	}
+
+	o.healthy, o.unhealthy = durations["healthy"], durations["unhealthy"]
+
+	// a single period is used for both states
+	if o.healthy == 0 {
+		o.healthy = o.unhealthy
+	}
+
+	if o.unhealthy == 0 {
+		o.unhealthy = o.healthy
+	}
+
+	if (o.Healthy != "" || o.Unhealthy != "") && o.healthy == 0 {
+		return errors.New("flapping periods must be longer than 0")
+	}
+
+	if o.Status == 0 {
+		o.Status = http.StatusServiceUnavailable
+	}
+
+	if o.Status < 400 || o.Status > 599 {
+		return errors.New("invalid outage status, use 400 to 599")
+	}
+
+	return nil
+}
+
+// down tells whether the service is unhealthy at the given time and, if known, when it recovers
+func (o *outage) down(at time.Time) (bool, time.Time) {
+	if at.Before(o.From) || (o.Until != nil && !at.Before(*o.Until)) {
+		return false, time.Time{}
+	}
+
+	var recovery time.Time
+
+	if o.Until != nil {
+		recovery = *o.Until
+	}
+
+	if o.healthy == 0 {
+		return true, recovery
+	}
+
+	period := o.healthy + o.unhealthy
+	phase := at.Sub(o.From) % period
+
+	if phase < o.healthy {
+		return false, time.Time{}
+	}
+
+	if next := at.Add(period - phase); recovery.IsZero() || next.Before(recovery) {
+		recovery = next
+	}
+
+	return true, recovery
+}
+
+// add stores all outages or none of them
+func (ot *outageStore) add(outages ...*outage) error {
+	ot.mtx.Lock()
+	defer ot.mtx.Unlock()
+	names := map[string]bool{}
+
+	for _, o := range outages {
+		if o.Name != "" && (names[o.Name] || ot.index(o.Name) >= 0) {
+			return errors.New("outage " + o.Name + " already exists")
+		}
+
+		names[o.Name] = true
+	}
+
+	for _, o := range outages {
+		for o.Name == "" {
+			ot.seq++
+
+			if name := "outage-" + strconv.Itoa(ot.seq); !names[name] && ot.index(name) < 0 {
+				o.Name = name
+			}
+		}
+
+		ot.outages = append(ot.outages, o)
+	}
+
+	return nil
+}
+
+// index must be called with the lock held
+func (ot *outageStore) index(name string) int {
+	for i, o := range ot.outages {
+		if o.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (ot *outageStore) list() []*outage {
+	ot.mtx.RLock()
+	defer ot.mtx.RUnlock()
+
+	return append([]*outage{}, ot.outages...)
+}
+
+func (ot *outageStore) get(name string) *outage {
+	ot.mtx.RLock()
+	defer ot.mtx.RUnlock()
+
+	if i := ot.index(name); i >= 0 {
+		return ot.outages[i]
+	}
+
+	return nil
+}
+
+func (ot *outageStore) remove(name string) bool {
+	ot.mtx.Lock()
+	defer ot.mtx.Unlock()
+
+	if i := ot.index(name); i >= 0 {
+		ot.outages = append(ot.outages[:i], ot.outages[i+1:]...)
+		return true
+	}
+
+	return false
+}
+
+func (ot *outageStore) clear() {
+	ot.mtx.Lock()
+	defer ot.mtx.Unlock()
+
+	ot.outages = nil
+}
+
+// active returns the first outage the service is in at the given time, and when it recovers
+func (ot *outageStore) active(at time.Time) (*outage, time.Time) {
+	ot.mtx.RLock()
+	defer ot.mtx.RUnlock()
+
+	for _, o := range ot.outages {
+		if down, recovery := o.down(at); down {
+			return o, recovery
+		}
+	}
+
+	return nil, time.Time{}
+}
+
+// loadOutages schedules the comma separated outages, in the compact form, from now
+func (srv *server) loadOutages(specs string) error {
+	log.Debug().Msg("entering loadOutages")
+	now := time.Now()
+	var outages []*outage
+
+	for _, spec := range strings.Split(specs, ",") {
+		o, err := parseOutage(spec)
+
+		if err == nil {
+			err = o.schedule(now)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		outages = append(outages, o)
+	}
+
+	if err := srv.out.add(outages...); err != nil {
+		return err
+	}
+
+	log.Info().Int("outages", len(outages)).Msg("outages scheduled")
+	log.Debug().Msg("leaving loadOutages")
+	return nil
+}
+
+func (srv *server) handleOutages(next http.HandlerFunc) http.HandlerFunc {
+	log.Debug().Msg("entering handleOutages")
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		if srv.out == nil {
+			next(res, req)
+			return
+		}
+
+		o, recovery := srv.out.active(time.Now())
+
+		if o == nil {
+			next(res, req)
+			return
+		}
+
+		log.Warn().
+			Str("protocol", req.Proto).
+			Str("remoteAddress", req.RemoteAddr).
+			Str("method", req.Method).
+			Str("host", req.Host).
+			Str("path", req.RequestURI).
+			Str("outage", o.Name).
+			Msg("handleOutages")
+
+		if entry := requestEntry(req); entry != nil {
+			entry.Outage = o.Name
+		}
+
+		if !recovery.IsZero() {
+			res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(recovery).Seconds()))))
+		}
+
+		http.Error(res, http.StatusText(int(o.Status)), int(o.Status))
+		log.Debug().Msg("leaving handleOutages")
+	}
+}
+
+func (srv *server) handleOutagesAPI() http.HandlerFunc {
+	log.Debug().Msg("entering handleOutagesAPI")
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		log.Info().
+			Str("protocol", req.Proto).
+			Str("remoteAddress", req.RemoteAddr).
+			Str("method", req.Method).
+			Str("host", req.Host).
+			Str("path", req.RequestURI).
+			Msg("handleOutagesAPI")
+
+		name := req.PathValue("name")
+		res.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case req.Method == http.MethodGet && name == "":
+			data, _ := json.Marshal(srv.out.list())
+			srv.respond(res, encodingJSON, 0, string(data))
+		case req.Method == http.MethodGet:
+			if o := srv.out.get(name); o != nil {
+				data, _ := json.Marshal(o)
+				srv.respond(res, encodingJSON, 0, string(data))
+			} else {
+				http.Error(res, "Not Found", http.StatusNotFound)
+			}
+		case req.Method == http.MethodPost && name == "":
+			body := &bytes.Buffer{}
+
+			if _, err := body.ReadFrom(req.Body); err != nil {
+				log.Error().Msg("Error reading request body")
+				http.Error(res, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+
+			outages, err := parseOutages(body.Bytes(), time.Now())
+
+			if err != nil {
+				log.Error().Msg("Invalid outage: " + err.Error())
+				http.Error(res, "Bad Request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if err = srv.out.add(outages...); err != nil {
+				log.Error().Msg(err.Error())
+				http.Error(res, "Conflict: "+err.Error(), http.StatusConflict)
+				return
+			}
+
+			data, _ := json.Marshal(outages)
+			res.WriteHeader(http.StatusCreated)
+			srv.respond(res, encodingJSON, 0, string(data))
+		case req.Method == http.MethodDelete && name == "":
+			srv.out.clear()
+			res.WriteHeader(http.StatusNoContent)
+		case req.Method == http.MethodDelete:
+			if srv.out.remove(name) {
+				res.WriteHeader(http.StatusNoContent)
+			} else {
+				http.Error(res, "Not Found", http.StatusNotFound)
+			}
+		default:
+			log.Error().Msg("Method " + req.Method + " not allowed for " + req.URL.Path)
+			http.Error(res, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+
+		log.Debug().Msg("leaving handleOutagesAPI")
+	}
+}
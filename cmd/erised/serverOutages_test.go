@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+)
+
+func TestErisedOutages(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	svr := &server{mck: &mockStore{}, jnl: newJournal(10), out: &outageStore{}}
+	svr.mux = &http.ServeMux{}
+	svr.mux.HandleFunc("/", svr.handleOutages(svr.handleMocks(svr.handleLanding())))
+	svr.mux.HandleFunc("/erised/outages", svr.handleOutagesAPI())
+	svr.mux.HandleFunc("/erised/outages/{name}", svr.handleOutagesAPI())
+	ts := httptest.NewServer(svr.handleJournal(svr.mux))
+	defer ts.Close()
+	now := time.Now()
+
+	do := func(method, path, body string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer func() { _ = res.Body.Close() }()
+		data, _ := io.ReadAll(res.Body)
+		return res, string(data)
+	}
+
+	g.Describe("Test outages", func() {
+		g.It("Should parse the compact form", func() {
+			o, err := parseOutage("30s-90s")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(o.schedule(now)).Should(Succeed())
+			Ω(o.From).Should(Equal(now.Add(30 * time.Second)))
+			Ω(*o.Until).Should(Equal(now.Add(90 * time.Second)))
+			Ω(o.Status).Should(BeEquivalentTo(http.StatusServiceUnavailable))
+
+			o, _ = parseOutage("Flap:10s/5s:InternalServerError")
+			Ω(o.schedule(now)).Should(Succeed())
+			Ω(o.healthy).Should(Equal(10 * time.Second))
+			Ω(o.unhealthy).Should(Equal(5 * time.Second))
+			Ω(o.Status).Should(BeEquivalentTo(http.StatusInternalServerError))
+			Ω(o.Until).Should(BeNil())
+
+			o, _ = parseOutage("1m-:502")
+			Ω(o.schedule(now)).Should(Succeed())
+			Ω(o.Until).Should(BeNil())
+			Ω(o.Status).Should(BeEquivalentTo(http.StatusBadGateway))
+
+			_, err = parseOutage("soon")
+			Ω(err).Should(HaveOccurred())
+
+			for _, spec := range []string{"90s-30s", "later-90s", "0s-10s:200", "0s-10s:Created", "flap:0s", "flap:fast"} {
+				o, err = parseOutage(spec)
+				Ω(err).ShouldNot(HaveOccurred(), spec)
+				Ω(o.schedule(now)).ShouldNot(Succeed(), spec)
+			}
+		})
+
+		g.It("Should fail within the window only", func() {
+			o, _ := parseOutage("30s-90s")
+			_ = o.schedule(now)
+
+			down, _ := o.down(now.Add(29 * time.Second))
+			Ω(down).Should(BeFalse())
+			down, recovery := o.down(now.Add(30 * time.Second))
+			Ω(down).Should(BeTrue())
+			Ω(recovery).Should(Equal(now.Add(90 * time.Second)))
+			down, _ = o.down(now.Add(90 * time.Second))
+			Ω(down).Should(BeFalse())
+		})
+
+		g.It("Should flap between healthy and unhealthy", func() {
+			o, _ := parseOutage("flap:10s")
+			_ = o.schedule(now)
+
+			down, _ := o.down(now.Add(5 * time.Second))
+			Ω(down).Should(BeFalse())
+			down, recovery := o.down(now.Add(15 * time.Second))
+			Ω(down).Should(BeTrue())
+			Ω(recovery).Should(Equal(now.Add(20 * time.Second)))
+			down, _ = o.down(now.Add(25 * time.Second))
+			Ω(down).Should(BeFalse())
+			down, _ = o.down(now.Add(35 * time.Second))
+			Ω(down).Should(BeTrue())
+		})
+
+		g.It("Should manage outages at runtime", func() {
+			res, _ := do(http.MethodGet, "/", "")
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+
+			res, body := do(http.MethodPost, "/erised/outages", `{"name":"db","end":"1h","status":504}`)
+			Ω(res).Should(HaveHTTPStatus(http.StatusCreated))
+			Ω(body).Should(ContainSubstring(`"until"`))
+			res, _ = do(http.MethodPost, "/erised/outages", `{"name":"db"}`)
+			Ω(res).Should(HaveHTTPStatus(http.StatusConflict))
+			res, _ = do(http.MethodPost, "/erised/outages", `{"start":"1h","end":"1m"}`)
+			Ω(res).Should(HaveHTTPStatus(http.StatusBadRequest))
+			res, body = do(http.MethodPost, "/erised/outages", `["2h-3h", "flap:1h"]`)
+			Ω(res).Should(HaveHTTPStatus(http.StatusCreated))
+			Ω(body).Should(ContainSubstring(`"name":"outage-1"`))
+			Ω(svr.out.list()).Should(HaveLen(3))
+
+			res, _ = do(http.MethodGet, "/orders", "")
+			Ω(res).Should(HaveHTTPStatus(http.StatusGatewayTimeout))
+			Ω(res.Header.Get("Retry-After")).Should(Equal("3600"))
+			entries := svr.jnl.list(journalFilter{Path: "/orders"})
+			Ω(entries).Should(HaveLen(1))
+			Ω(entries[0].Outage).Should(Equal("db"))
+
+			res, _ = do(http.MethodGet, "/erised/outages/db", "")
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			res, _ = do(http.MethodDelete, "/erised/outages/db", "")
+			Ω(res).Should(HaveHTTPStatus(http.StatusNoContent))
+			res, _ = do(http.MethodGet, "/orders", "")
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+
+			res, _ = do(http.MethodDelete, "/erised/outages", "")
+			Ω(res).Should(HaveHTTPStatus(http.StatusNoContent))
+			Ω(svr.out.list()).Should(BeEmpty())
+		})
+
+		g.It("Should schedule outages from the command line", func() {
+			Ω(svr.loadOutages("0s-100ms:Teapot, flap:1h")).Should(Succeed())
+			defer svr.out.clear()
+
+			res, _ := do(http.MethodGet, "/", "")
+			Ω(res).Should(HaveHTTPStatus(http.StatusTeapot))
+			Eventually(func() int { res, _ := do(http.MethodGet, "/", ""); return res.StatusCode }).Should(Equal(http.StatusOK))
+
+			Ω(svr.loadOutages("0s-100ms,never")).ShouldNot(Succeed())
+		})
+	})
+}
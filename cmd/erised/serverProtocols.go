@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	h2Undecided = iota
+	h2Upgrade
+	h2Frames
+)
+
+const (
+	frameHeaderLen    = 9
+	frameHeaders      = 0x1
+	frameRSTStream    = 0x3
+	frameContinuation = 0x9
+	flagEndHeaders    = 0x4
+	flagPadded        = 0x8
+	flagPriority      = 0x20
+)
+
+// end of the client connection preface. The h2c handler reads the start of it as an HTTP/1.1 request
+var clientPrefaceEnd = []byte("SM\r\n\r\n")
+
+// error code sent by rejected streams, HTTP_1_1_REQUIRED (RFC 9113 section 7)
+var http11Required = []byte{0, 0, 0, byte(http2.ErrCodeHTTP11Required)}
+
+type h2ConnKey struct{}
+
+// h2Conn carries the frames of an HTTP/2 connection. The http2 package resets the streams of aborted
+// handlers with INTERNAL_ERROR, so the code of the resets of the streams rejected for asking for HTTP/1.1
+// is rewritten
+type h2Conn struct {
+	net.Conn
+	in      io.Reader
+	req     h2Requests
+	mu      sync.Mutex
+	state   int
+	matched int
+	header  []byte
+	left    int
+	offset  int
+	reset   bool
+	pending map[uint32]bool
+}
+
+// h2Requests follows the frames read from the client, decoding the headers of every stream to find the
+// ones asking for HTTP/1.1
+type h2Requests struct {
+	preface int
+	header  []byte
+	left    int
+	payload []byte
+	block   []byte
+	stream  uint32
+	dec     *hpack.Decoder
+	failed  bool
+}
+
+// h2TLSConn exposes the TLS state to the HTTP/2 server
+type h2TLSConn struct {
+	*h2Conn
+	tls *tls.Conn
+}
+
+// h2cWriter hands the hijacked connection of h2c requests to the HTTP/2 server wrapped in an h2Conn
+type h2cWriter struct {
+	http.ResponseWriter
+	conn *h2Conn
+}
+
+func (c *h2TLSConn) ConnectionState() tls.ConnectionState {
+	return c.tls.ConnectionState()
+}
+
+func (hw *h2cWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(hw.ResponseWriter).Hijack()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hw.conn.Conn, hw.conn.in = conn, rw.Reader
+	return hw.conn, bufio.NewReadWriter(bufio.NewReader(hw.conn), bufio.NewWriter(hw.conn)), nil
+}
+
+func (hw *h2cWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+func (hc *h2Conn) reject(stream uint32) {
+	hc.mu.Lock()
+
+	if hc.pending == nil {
+		hc.pending = map[uint32]bool{}
+	}
+
+	hc.pending[stream] = true
+	hc.mu.Unlock()
+}
+
+func (hc *h2Conn) Read(p []byte) (int, error) {
+	in := hc.in
+
+	if in == nil {
+		in = hc.Conn
+	}
+
+	n, err := in.Read(p)
+	hc.scan(p[:n])
+	return n, err
+}
+
+// scan follows the frame boundaries after the client connection preface
+func (hc *h2Conn) scan(p []byte) {
+	rq := &hc.req
+
+	for i := 0; i < len(p) && !rq.failed; {
+		if rq.preface < len(clientPrefaceEnd) {
+			switch {
+			case p[i] == clientPrefaceEnd[rq.preface]:
+				rq.preface++
+			case p[i] == clientPrefaceEnd[0]:
+				rq.preface = 1
+			default:
+				rq.preface = 0
+			}
+
+			i++
+			continue
+		}
+
+		if len(rq.header) < frameHeaderLen {
+			rq.header = append(rq.header, p[i])
+			i++
+
+			if len(rq.header) == frameHeaderLen {
+				rq.left = int(rq.header[0])<<16 | int(rq.header[1])<<8 | int(rq.header[2])
+				rq.payload = rq.payload[:0]
+
+				if rq.left == 0 {
+					hc.frameRead()
+				}
+			}
+
+			continue
+		}
+
+		n := min(rq.left, len(p)-i)
+
+		if rq.header[3] == frameHeaders || rq.header[3] == frameContinuation {
+			rq.payload = append(rq.payload, p[i:i+n]...)
+		}
+
+		rq.left -= n
+		i += n
+
+		if rq.left == 0 {
+			hc.frameRead()
+		}
+	}
+}
+
+// frameRead collects the header blocks of the requests, rejecting the streams whose X-Erised-Protocol
+// is HTTP/1.1. Once a block can't be decoded the following ones can't either, so the connection is no
+// longer followed
+func (hc *h2Conn) frameRead() {
+	rq := &hc.req
+	kind, flags, payload := rq.header[3], rq.header[4], rq.payload
+	stream := binary.BigEndian.Uint32(rq.header[5:]) & 0x7fffffff
+	rq.header = rq.header[:0]
+
+	switch kind {
+	case frameHeaders:
+		if flags&flagPadded != 0 && len(payload) > 0 {
+			pad := int(payload[0])
+			payload = payload[1:max(len(payload)-pad, 1)]
+		}
+
+		if flags&flagPriority != 0 {
+			payload = payload[min(5, len(payload)):]
+		}
+
+		rq.stream, rq.block = stream, append(rq.block[:0], payload...)
+	case frameContinuation:
+		rq.block = append(rq.block, payload...)
+	default:
+		return
+	}
+
+	if flags&flagEndHeaders == 0 {
+		return
+	}
+
+	if rq.dec == nil {
+		rq.dec = hpack.NewDecoder(4096, func(f hpack.HeaderField) {
+			if f.Name == "x-erised-protocol" && strings.EqualFold(f.Value, "HTTP/1.1") {
+				hc.reject(rq.stream)
+			}
+		})
+	}
+
+	_, err := rq.dec.Write(rq.block)
+
+	if err == nil {
+		err = rq.dec.Close()
+	}
+
+	if err != nil {
+		log.Warn().Msg("Unable to decode HTTP/2 headers, rejected streams will be reset with INTERNAL_ERROR: " + err.Error())
+		rq.failed = true
+	}
+}
+
+func (hc *h2Conn) Write(p []byte) (int, error) {
+	hc.mu.Lock()
+	out := hc.rewrite(p)
+	hc.mu.Unlock()
+	return hc.Conn.Write(out)
+}
+
+// rewrite follows the frame boundaries, skipping the 101 Switching Protocols response of h2c upgrades.
+// The frames are only copied when they reset a rejected stream
+func (hc *h2Conn) rewrite(p []byte) []byte {
+	out := p
+	copied := false
+
+	for i := 0; i < len(out); {
+		if hc.state == h2Undecided {
+			hc.state = h2Frames
+
+			if out[i] == 'H' {
+				hc.state = h2Upgrade
+			}
+		}
+
+		if hc.state == h2Upgrade {
+			switch {
+			case out[i] == "\r\n\r\n"[hc.matched]:
+				hc.matched++
+			case out[i] == '\r':
+				hc.matched = 1
+			default:
+				hc.matched = 0
+			}
+
+			if hc.matched == 4 {
+				hc.state = h2Frames
+			}
+
+			i++
+			continue
+		}
+
+		if len(hc.header) < frameHeaderLen {
+			hc.header = append(hc.header, out[i])
+			i++
+
+			if len(hc.header) == frameHeaderLen {
+				hc.left = int(hc.header[0])<<16 | int(hc.header[1])<<8 | int(hc.header[2])
+				hc.offset = 0
+				stream := binary.BigEndian.Uint32(hc.header[5:]) & 0x7fffffff
+				hc.reset = hc.header[3] == frameRSTStream && hc.left == len(http11Required) && hc.pending[stream]
+
+				if hc.reset {
+					delete(hc.pending, stream)
+				}
+
+				if hc.left == 0 {
+					hc.header = hc.header[:0]
+				}
+			}
+
+			continue
+		}
+
+		n := min(hc.left, len(out)-i)
+
+		if hc.reset {
+			if !copied {
+				out, copied = append([]byte(nil), p...), true
+			}
+
+			copy(out[i:i+n], http11Required[hc.offset:hc.offset+n])
+		}
+
+		hc.offset += n
+		hc.left -= n
+		i += n
+
+		if hc.left == 0 {
+			hc.header = hc.header[:0]
+		}
+	}
+
+	return out
+}
+
+// setupProtocols serves HTTP/2 over TLS and, optionally, over cleartext connections (h2c),
+// or restricts the server to HTTP/1.1
+func (srv *server) setupProtocols(cleartext, http1 bool) error {
+	log.Debug().Msg("entering setupProtocols")
+
+	if cleartext && http1 {
+		return errors.New("h2c and HTTP/1.1 only are mutually exclusive")
+	}
+
+	if http1 {
+		srv.cfg.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		log.Info().Msg("HTTP/2 disabled")
+		return nil
+	}
+
+	h2s := &http2.Server{IdleTimeout: srv.cfg.IdleTimeout}
+
+	if err := http2.ConfigureServer(srv.cfg, h2s); err != nil {
+		return err
+	}
+
+	srv.cfg.TLSNextProto[http2.NextProtoTLS] = func(hs *http.Server, c *tls.Conn, h http.Handler) {
+		ctx := context.Background()
+
+		if bc, ok := h.(interface{ BaseContext() context.Context }); ok {
+			ctx = bc.BaseContext()
+		}
+
+		hc := &h2Conn{Conn: c, state: h2Frames}
+		h2s.ServeConn(&h2TLSConn{h2Conn: hc, tls: c}, &http2.ServeConnOpts{
+			Context:    context.WithValue(ctx, h2ConnKey{}, hc),
+			BaseConfig: hs,
+			Handler:    h,
+		})
+	}
+
+	if cleartext {
+		srv.cfg.Handler = srv.handleH2C(srv.cfg.Handler, h2s)
+		log.Info().Msg("h2c enabled")
+	}
+
+	log.Debug().Msg("leaving setupProtocols")
+	return nil
+}
+
+// handleH2C accepts h2c connections with prior knowledge or through an HTTP/1.1 Upgrade
+func (srv *server) handleH2C(next http.Handler, h2s *http2.Server) http.Handler {
+	log.Debug().Msg("entering handleH2C")
+	h2 := h2c.NewHandler(next, h2s)
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "PRI" && !strings.Contains(strings.ToLower(req.Header.Get("Upgrade")), "h2c") {
+			h2.ServeHTTP(res, req)
+			return
+		}
+
+		log.Info().
+			Str("protocol", req.Proto).
+			Str("remoteAddress", req.RemoteAddr).
+			Str("method", req.Method).
+			Str("host", req.Host).
+			Str("path", req.RequestURI).
+			Msg("handleH2C")
+		hc := &h2Conn{}
+		h2.ServeHTTP(&h2cWriter{ResponseWriter: res, conn: hc}, req.WithContext(context.WithValue(req.Context(), h2ConnKey{}, hc)))
+		log.Debug().Msg("leaving handleH2C")
+	})
+}
+
+// handleProtocol resets HTTP/2 streams with HTTP_1_1_REQUIRED, and HTTP/3 streams with H3_VERSION_FALLBACK,
+// when X-Erised-Protocol is HTTP/1.1
+func (srv *server) handleProtocol(next http.Handler) http.Handler {
+	log.Debug().Msg("entering handleProtocol")
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		xProtocol := req.Header.Get("X-Erised-Protocol")
+		hc, _ := req.Context().Value(h2ConnKey{}).(*h2Conn)
+
+		// requests upgraded to h2c keep their HTTP/1.1 protocol version, but are answered on stream 1
+		if (req.ProtoMajor < 2 && hc == nil) || !strings.EqualFold(xProtocol, "HTTP/1.1") {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		log.Warn().
+			Str("protocol", req.Proto).
+			Str("remoteAddress", req.RemoteAddr).
+			Str("method", req.Method).
+			Str("host", req.Host).
+			Str("path", req.RequestURI).
+			Msg("Rejecting " + req.Proto + " request")
+
+		// the h2Conn finds the streams to reject in their headers, but upgraded requests are read as HTTP/1.1
+		if hc != nil && req.ProtoMajor < 2 {
+			hc.reject(1)
+		}
+
+		if hs, ok := res.(http3.HTTPStreamer); ok {
+			str := hs.HTTPStream()
+			str.CancelRead(quic.StreamErrorCode(http3.ErrCodeVersionFallback))
+			str.CancelWrite(quic.StreamErrorCode(http3.ErrCodeVersionFallback))
+		}
+
+		// the stream is reset as soon as the handler is aborted
+		panic(http.ErrAbortHandler)
+	})
+}
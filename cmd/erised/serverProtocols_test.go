@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestErisedProtocols(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	start := func(cleartext, http1, useTLS bool) *httptest.Server {
+		svr := &server{}
+		svr.cfg = &http.Server{Handler: svr.handleProtocol(svr.handleLanding())}
+		Ω(svr.setupProtocols(cleartext, http1)).Should(Succeed())
+		ts := httptest.NewUnstartedServer(nil)
+		ts.Config = svr.cfg
+
+		if useTLS {
+			if svr.cfg.TLSConfig != nil {
+				ts.TLS = svr.cfg.TLSConfig.Clone()
+			}
+
+			ts.StartTLS()
+		} else {
+			ts.Start()
+		}
+
+		return ts
+	}
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	h2Client := &http.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	get := func(client *http.Client, url, protocol string) (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("X-Erised-Data", "Hello")
+
+		if protocol != "" {
+			req.Header.Set("X-Erised-Protocol", protocol)
+		}
+
+		return client.Do(req)
+	}
+	streamCode := func(err error) http2.ErrCode {
+		var se http2.StreamError
+
+		if errors.As(err, &se) {
+			return se.Code
+		}
+
+		return http2.ErrCodeNo
+	}
+
+	g.Describe("Test protocol selection", func() {
+		g.It("Should not allow h2c with HTTP/1.1 only", func() {
+			svr := &server{cfg: &http.Server{}}
+
+			Ω(svr.setupProtocols(true, true)).ShouldNot(Succeed())
+		})
+
+		g.It("Should serve h2c with prior knowledge", func() {
+			ts := start(true, false, false)
+			defer ts.Close()
+			res, err := get(h2cClient, ts.URL, "")
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(res.ProtoMajor).Should(Equal(2))
+			Ω(res).Should(HaveHTTPBody("Hello"))
+
+			res, err = http.Get(ts.URL)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(res.ProtoMajor).Should(Equal(1))
+		})
+
+		g.It("Should reject h2c with HTTP_1_1_REQUIRED", func() {
+			ts := start(true, false, false)
+			defer ts.Close()
+			_, err := get(h2cClient, ts.URL, "HTTP/1.1")
+			Ω(streamCode(err)).Should(Equal(http2.ErrCodeHTTP11Required))
+
+			res, err := get(h2cClient, ts.URL, "")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(res).Should(HaveHTTPBody("Hello"))
+		})
+
+		g.It("Should reject upgraded h2c requests with HTTP_1_1_REQUIRED", func() {
+			ts := start(true, false, false)
+			defer ts.Close()
+			conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+			Ω(err).ShouldNot(HaveOccurred())
+			defer func() { _ = conn.Close() }()
+
+			_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\n" +
+				"Upgrade: h2c\r\nHTTP2-Settings: \r\nX-Erised-Protocol: HTTP/1.1\r\n\r\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			br := bufio.NewReader(conn)
+			res, err := http.ReadResponse(br, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(res).Should(HaveHTTPStatus(http.StatusSwitchingProtocols))
+
+			_, err = conn.Write([]byte(http2.ClientPreface))
+			Ω(err).ShouldNot(HaveOccurred())
+			framer := http2.NewFramer(conn, br)
+			Ω(framer.WriteSettings()).Should(Succeed())
+			var code http2.ErrCode
+
+			for code == http2.ErrCodeNo {
+				frame, err := framer.ReadFrame()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				if rst, ok := frame.(*http2.RSTStreamFrame); ok && rst.StreamID == 1 {
+					code = rst.ErrCode
+				}
+			}
+
+			Ω(code).Should(Equal(http2.ErrCodeHTTP11Required))
+		})
+
+		g.It("Should reject HTTP/2 over TLS with HTTP_1_1_REQUIRED", func() {
+			ts := start(false, false, true)
+			defer ts.Close()
+			res, err := get(h2Client, ts.URL, "")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(res.ProtoMajor).Should(Equal(2))
+			Ω(res.TLS).ShouldNot(BeNil())
+
+			_, err = get(h2Client, ts.URL, "http/1.1")
+			Ω(streamCode(err)).Should(Equal(http2.ErrCodeHTTP11Required))
+		})
+
+		g.It("Should serve HTTP/1.1 only", func() {
+			ts := start(false, true, true)
+			defer ts.Close()
+			client := &http.Client{Transport: &http.Transport{
+				ForceAttemptHTTP2: true,
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			}}
+			res, err := get(client, ts.URL, "HTTP/1.1")
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(res.ProtoMajor).Should(Equal(1))
+			Ω(res).Should(HaveHTTPBody("Hello"))
+		})
+	})
+
+	g.Describe("Test HTTP/2 frame rewriting", func() {
+		g.It("Should only rewrite pending resets", func() {
+			hc := &h2Conn{state: h2Frames}
+			settings := []byte{0, 0, 0, 0x4, 0, 0, 0, 0, 0}
+			rst := []byte{0, 0, 4, frameRSTStream, 0, 0, 0, 0, 1, 0, 0, 0, byte(http2.ErrCodeInternal)}
+			other := []byte{0, 0, 4, frameRSTStream, 0, 0, 0, 0, 3, 0, 0, 0, byte(http2.ErrCodeInternal)}
+
+			Ω(hc.rewrite(rst)).Should(Equal(rst))
+			hc.reject(1)
+			Ω(hc.rewrite(other)).Should(Equal(other))
+			frames := append(append([]byte{}, settings...), rst...)
+			out := append(hc.rewrite(frames[:11]), hc.rewrite(frames[11:])...)
+			Ω(out[len(out)-1]).Should(Equal(byte(http2.ErrCodeHTTP11Required)))
+			Ω(rst[len(rst)-1]).Should(Equal(byte(http2.ErrCodeInternal)))
+			Ω(hc.rewrite(rst)).Should(Equal(rst))
+		})
+
+		g.It("Should find the streams asking for HTTP/1.1 in the requests read", func() {
+			block := func(fields ...string) []byte {
+				buf := &bytes.Buffer{}
+				enc := hpack.NewEncoder(buf)
+
+				for i := 0; i < len(fields); i += 2 {
+					_ = enc.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+				}
+
+				return buf.Bytes()
+			}
+			frames := &bytes.Buffer{}
+			fr := http2.NewFramer(frames, nil)
+			_ = fr.WriteSettings()
+			rejected := block(":method", "GET", ":path", "/", "x-erised-protocol", "http/1.1")
+			_ = fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 3, BlockFragment: rejected[:4], PadLength: 2,
+				Priority: http2.PriorityParam{Weight: 15}})
+			_ = fr.WriteContinuation(3, true, rejected[4:])
+			_ = fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 5, BlockFragment: block(":method", "GET", ":path", "/"), EndHeaders: true})
+
+			hc := &h2Conn{state: h2Frames}
+			data := append([]byte(http2.ClientPreface), frames.Bytes()...)
+			hc.scan(data[:30])
+			hc.scan(data[30:])
+			Ω(hc.pending).Should(Equal(map[uint32]bool{3: true}))
+		})
+
+		g.It("Should not copy frames without pending resets", func() {
+			hc := &h2Conn{state: h2Frames}
+			data := []byte{0, 0, 2, 0x0, 0, 0, 0, 0, 1, 'h', 'i'}
+
+			Ω(&hc.rewrite(data)[0]).Should(BeIdenticalTo(&data[0]))
+		})
+
+		g.It("Should skip the upgrade response", func() {
+			hc := &h2Conn{pending: map[uint32]bool{1: true}}
+			head := []byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: h2c\r\n\r\n")
+			out := hc.rewrite(append(head, 0, 0, 4, frameRSTStream, 0, 0, 0, 0, 1, 0, 0, 0, 2))
+
+			Ω(string(out[:len(head)])).Should(Equal(string(head)))
+			Ω(out[len(out)-1]).Should(Equal(byte(http2.ErrCodeHTTP11Required)))
+		})
+	})
+}
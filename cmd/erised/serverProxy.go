@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	recordingsFile = "erised_recordings.json"
+	recordingLimit = 10 << 20
+)
+
+type recorder struct {
+	mtx   sync.Mutex
+	dir   string
+	rules []*mockRule
+}
+
+// recordingBody streams the upstream response to the client while keeping a copy of it. The response is
+// recorded once its body is read to the end, unless it is longer than limit
+type recordingBody struct {
+	io.ReadCloser
+	buf   bytes.Buffer
+	limit int
+	over  bool
+	done  func(body []byte)
+}
+
+func (srv *server) setupProxy(upstream string) error {
+	log.Debug().Msg("entering setupProxy")
+	target, err := url.Parse(upstream)
+
+	if err != nil {
+		return err
+	}
+
+	if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return errors.New("invalid upstream " + upstream + ", an absolute http or https URL is required")
+	}
+
+	srv.prx = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.SetXForwarded()
+			// let the transport negotiate compression so recorded bodies are stored uncompressed
+			r.Out.Header.Del("Accept-Encoding")
+		},
+		ModifyResponse: srv.record,
+		ErrorHandler: func(res http.ResponseWriter, req *http.Request, err error) {
+			log.Error().Msg("Upstream error: " + err.Error())
+			http.Error(res, "Bad Gateway", http.StatusBadGateway)
+		},
+	}
+
+	if srv.pth == "" {
+		log.Warn().Msg("Responses will not be recorded, the -path option is required")
+	} else {
+		srv.rec = &recorder{dir: srv.pth}
+
+		if data, err := os.ReadFile(filepath.Join(srv.pth, recordingsFile)); err == nil {
+			if srv.rec.rules, err = parseMocks(data); err != nil {
+				return errors.New("unable to load existing recordings: " + err.Error())
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	log.Info().Str("upstream", target.String()).Str("recordings", srv.pth).Msg("proxy mode enabled")
+	log.Debug().Msg("leaving setupProxy")
+	return nil
+}
+
+func (srv *server) handleProxy(next http.HandlerFunc) http.HandlerFunc {
+	log.Debug().Msg("entering handleProxy")
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		if srv.prx == nil {
+			next(res, req)
+			return
+		}
+
+		log.Info().
+			Str("protocol", req.Proto).
+			Str("remoteAddress", req.RemoteAddr).
+			Str("method", req.Method).
+			Str("host", req.Host).
+			Str("path", req.RequestURI).
+			Msg("handleProxy")
+		srv.prx.ServeHTTP(res, req)
+		log.Debug().Msg("leaving handleProxy")
+	}
+}
+
+func (srv *server) record(resp *http.Response) error {
+	log.Debug().Msg("entering record")
+
+	if srv.rec == nil {
+		return nil
+	}
+
+	hash := sha1.Sum([]byte(resp.Request.Method + " " + resp.Request.URL.Path + "?" + resp.Request.URL.RawQuery))
+	rule := &mockRule{
+		ID:     "rec-" + hex.EncodeToString(hash[:6]),
+		Method: resp.Request.Method,
+		Path:   resp.Request.URL.Path,
+		mockResponse: mockResponse{
+			Status:  statusCode(resp.StatusCode),
+			Headers: map[string]interface{}{},
+		},
+	}
+
+	// requests with a query are replayed before the recording of the bare path
+	if query := resp.Request.URL.Query(); len(query) > 0 {
+		rule.Priority = 1
+		rule.Match = &requestMatcher{Query: map[string]*valueMatcher{}}
+
+		for k := range query {
+			rule.Match.Query[k] = &valueMatcher{Equals: query.Get(k)}
+		}
+	}
+
+	for k, v := range resp.Header {
+		if k != "Content-Length" && k != "Date" {
+			rule.Headers[k] = strings.Join(v, ", ")
+		}
+	}
+
+	path := resp.Request.URL.RequestURI()
+	resp.Body = &recordingBody{ReadCloser: resp.Body, limit: recordingLimit, done: func(body []byte) {
+		if len(body) > 0 {
+			rule.BodyFile = rule.ID + ".body"
+		}
+
+		if err := srv.rec.save(rule, body); err != nil {
+			log.Error().Msg("Unable to save recording: " + err.Error())
+		} else {
+			log.Info().Str("mock", rule.ID).Str("method", rule.Method).Str("path", path).Msg("response recorded")
+		}
+	}}
+
+	log.Debug().Msg("leaving record")
+	return nil
+}
+
+func (rb *recordingBody) Read(p []byte) (int, error) {
+	n, err := rb.ReadCloser.Read(p)
+
+	if !rb.over && rb.buf.Len()+n > rb.limit {
+		log.Warn().Int("limit", rb.limit).Msg("Response too large to be recorded")
+		rb.over = true
+		rb.buf = bytes.Buffer{}
+	}
+
+	if !rb.over {
+		rb.buf.Write(p[:n])
+	}
+
+	// interrupted responses are never recorded
+	if errors.Is(err, io.EOF) && !rb.over && rb.done != nil {
+		rb.done(rb.buf.Bytes())
+		rb.done = nil
+	}
+
+	return n, err
+}
+
+// save stores the body file and rewrites the recordings file, replacing any previous recording of the same route
+func (rec *recorder) save(rule *mockRule, body []byte) error {
+	rec.mtx.Lock()
+	defer rec.mtx.Unlock()
+
+	if rule.BodyFile != "" {
+		if err := os.WriteFile(filepath.Join(rec.dir, rule.BodyFile), body, 0644); err != nil {
+			return err
+		}
+	}
+
+	replaced := false
+
+	for i, r := range rec.rules {
+		if r.ID == rule.ID {
+			rec.rules[i], replaced = rule, true
+		}
+	}
+
+	if !replaced {
+		rec.rules = append(rec.rules, rule)
+	}
+
+	data, err := json.MarshalIndent(map[string]interface{}{"mocks": rec.rules}, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(rec.dir, recordingsFile), data, 0644)
+}
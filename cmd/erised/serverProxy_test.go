@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+)
+
+func TestErisedProxy(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	dir := t.TempDir()
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		calls++
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(http.StatusAccepted)
+		_, _ = res.Write([]byte(`{"value":"` + req.URL.RequestURI() + `"}`))
+	}))
+	defer upstream.Close()
+
+	g.Describe("Test proxy mode", func() {
+		g.It("Should reject invalid upstreams", func() {
+			svr := server{}
+
+			Ω(svr.setupProxy("localhost:9000")).ShouldNot(Succeed())
+		})
+
+		g.It("Should forward and record requests", func() {
+			svr := server{pth: dir, mck: &mockStore{}}
+			Ω(svr.setupProxy(upstream.URL)).Should(Succeed())
+
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/jokes/random", nil)
+			svr.handleMocks(svr.handleProxy(svr.handleLanding())).ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusAccepted))
+			Ω(res.Body.String()).Should(Equal(`{"value":"/jokes/random"}`))
+			Ω(calls).Should(Equal(1))
+			Ω(filepath.Join(dir, recordingsFile)).Should(BeAnExistingFile())
+		})
+
+		g.It("Should replay recorded requests", func() {
+			svr := server{pth: dir, mck: &mockStore{}}
+			Ω(svr.loadMocks(filepath.Join(dir, recordingsFile))).Should(Succeed())
+
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/jokes/random", nil)
+			svr.handleMocks(svr.handleProxy(svr.handleLanding())).ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusAccepted))
+			Ω(res.Header().Get("Content-Type")).Should(Equal("application/json"))
+			Ω(res.Body.String()).Should(Equal(`{"value":"/jokes/random"}`))
+			Ω(calls).Should(Equal(1))
+		})
+
+		g.It("Should keep previous recordings", func() {
+			svr := server{pth: dir, mck: &mockStore{}}
+			Ω(svr.setupProxy(upstream.URL)).Should(Succeed())
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/jokes/categories", nil)
+			svr.handleMocks(svr.handleProxy(svr.handleLanding())).ServeHTTP(httptest.NewRecorder(), req)
+			data, err := os.ReadFile(filepath.Join(dir, recordingsFile))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			rules, err := parseMocks(data)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(rules).Should(HaveLen(2))
+		})
+
+		g.It("Should record each query separately", func() {
+			svr := server{pth: dir, mck: &mockStore{}}
+			Ω(svr.setupProxy(upstream.URL)).Should(Succeed())
+
+			for _, path := range []string{"/jokes/search?page=1", "/jokes/search?page=2", "/jokes/search"} {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost:8080"+path, nil)
+				svr.handleMocks(svr.handleProxy(svr.handleLanding())).ServeHTTP(httptest.NewRecorder(), req)
+			}
+
+			replay := server{pth: dir, mck: &mockStore{}}
+			Ω(replay.loadMocks(filepath.Join(dir, recordingsFile))).Should(Succeed())
+
+			for _, path := range []string{"/jokes/search?page=1", "/jokes/search?page=2", "/jokes/search"} {
+				res := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, "http://localhost:8080"+path, nil)
+				replay.handleMocks(replay.handleLanding()).ServeHTTP(res, req)
+				Ω(res.Body.String()).Should(Equal(`{"value":"` + path + `"}`))
+			}
+		})
+
+		g.It("Should stream responses while recording them", func() {
+			release := make(chan struct{})
+			events := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				res.Header().Set("Content-Type", "text/event-stream")
+				_, _ = io.WriteString(res, "data: first\n\n")
+				res.(http.Flusher).Flush()
+				<-release
+				_, _ = io.WriteString(res, "data: last\n\n")
+			}))
+			defer events.Close()
+
+			svr := server{pth: t.TempDir(), mck: &mockStore{}}
+			Ω(svr.setupProxy(events.URL)).Should(Succeed())
+			ts := httptest.NewServer(svr.handleProxy(svr.handleLanding()))
+			defer ts.Close()
+
+			res, err := http.Get(ts.URL + "/events")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer func() { _ = res.Body.Close() }()
+			first := make([]byte, len("data: first\n\n"))
+			_, err = io.ReadFull(res.Body, first)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(first)).Should(Equal("data: first\n\n"))
+			Ω(filepath.Join(svr.pth, recordingsFile)).ShouldNot(BeAnExistingFile())
+
+			close(release)
+			rest, _ := io.ReadAll(res.Body)
+			Ω(string(rest)).Should(Equal("data: last\n\n"))
+			Eventually(filepath.Join(svr.pth, recordingsFile)).Should(BeAnExistingFile())
+		})
+
+		g.It("Should return BadGateway when the upstream is down", func() {
+			svr := server{mck: &mockStore{}}
+			Ω(svr.setupProxy("http://127.0.0.1:1")).Should(Succeed())
+
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/", nil)
+			svr.handleProxy(svr.handleLanding()).ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusBadGateway))
+		})
+	})
+}
@@ -5,10 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/fs"
+	"io"
 	"net/http"
 	"os"
-	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -19,11 +18,25 @@ import (
 
 func (srv *server) routes() {
 	log.Debug().Msg("entering routes")
-	go srv.mux.HandleFunc("/", srv.handleLanding())
+	go srv.mux.HandleFunc("/", srv.handleFaults(srv.handleOutages(srv.handleChaos(srv.handleUpstream(srv.handleValidation(srv.handleMocks(srv.handleGraphQL(srv.handleOpenAPI(srv.handleProxy(srv.handleLanding()))))))))))
 	go srv.mux.HandleFunc("/erised/headers", srv.handleHeaders())
 	go srv.mux.HandleFunc("/erised/info", srv.handleInfo())
 	go srv.mux.HandleFunc("/erised/ip", srv.handleIP())
+	go srv.mux.HandleFunc("/erised/mocks", srv.handleMocksAPI())
+	go srv.mux.HandleFunc("/erised/mocks/{id}", srv.handleMocksAPI())
+	go srv.mux.HandleFunc("/erised/outages", srv.handleOutagesAPI())
+	go srv.mux.HandleFunc("/erised/outages/{name}", srv.handleOutagesAPI())
+	go srv.mux.HandleFunc("/erised/requests", srv.handleRequests())
+	go srv.mux.HandleFunc("/erised/requests/count", srv.handleRequestsCount())
+	go srv.mux.HandleFunc("/erised/scenarios", srv.handleScenarios())
+	go srv.mux.HandleFunc("/erised/scenarios/{name}", srv.handleScenarios())
 	go srv.mux.HandleFunc("/erised/shutdown", srv.handleShutdown())
+	go srv.mux.HandleFunc("/erised/sse", srv.handleSSE())
+	go srv.mux.HandleFunc("/erised/tls", srv.handleTLS())
+	go srv.mux.HandleFunc("/erised/tls/faults", srv.handleTLSFaults())
+	go srv.mux.HandleFunc("/erised/toxics", srv.handleToxicsAPI())
+	go srv.mux.HandleFunc("/erised/toxics/{name}", srv.handleToxicsAPI())
+	go srv.mux.HandleFunc("/erised/ws", srv.handleWS())
 	go srv.mux.HandleFunc("/erised/echoserver", srv.handleEchoServer())
 	go srv.mux.HandleFunc("/erised/echoserver/{path...}", srv.handleEchoServer())
 	log.Debug().Msg("leaving routes")
@@ -81,50 +94,49 @@ func (srv *server) handleLanding() http.HandlerFunc {
 
 		if xResponseFile := req.Header.Get("X-Erised-Response-File"); xResponseFile != "" && srv.pth != "" {
 			log.Debug().Msg("X-Erised-Response-File: " + xResponseFile)
-			xStatusCode = http.StatusNotFound
+			xData, xStatusCode = srv.responseFile(xResponseFile)
+		} else {
+			xData = req.Header.Get("X-Erised-Data")
+			log.Debug().Msg("X-Erised-Data: " + xData)
+		}
 
-			err := filepath.WalkDir(srv.pth, func(path string, entry fs.DirEntry, err error) error {
+		if xTemplate, _ := strconv.ParseBool(req.Header.Get("X-Erised-Template")); xTemplate && xData != "" {
+			log.Debug().Msg("X-Erised-Template: true")
 
-				if err != nil {
-					log.Error().Msg("Invalid path: " + path)
-					log.Debug().Msg(fmt.Sprintf("Error: %v", err))
+			if out, err := render(xData, req, nil); err != nil {
+				log.Error().Msg("Unable to render template: " + err.Error())
+				xData, xStatusCode = "", http.StatusInternalServerError
+			} else {
+				xData = out
+			}
+		}
 
-					return errors.New("INVALID_PATH_ERROR")
-				}
+		if encoding == encodingSSE && xStatusCode < 300 {
+			events, err := parseEvents(xData)
 
-				if !entry.IsDir() && filepath.Base(path) == xResponseFile {
-					if ct, err := os.ReadFile(path); err != nil {
-						log.Error().Msg("Unable to open the file: " + path)
-						log.Debug().Msg(fmt.Sprintf("Error: %v", err))
+			if err != nil {
+				log.Error().Msg(err.Error())
+				http.Error(res, "Bad Request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
 
-						return errors.New("FILE_ACCESS_ERROR")
-					} else {
-						log.Info().Msg(fmt.Sprintf("Reading file %v", path))
-						xData = string(ct)
+			srv.stream(res, req, xStatusCode, delay, events)
+			log.Debug().Msg("leaving handleLanding")
+			return
+		}
 
-						return errors.New("FILE_FOUND")
-					}
-				}
+		xThroughput := req.Header.Get("X-Erised-Throughput")
+		log.Debug().Msg("X-Erised-Throughput: " + xThroughput)
+		rw, err := srv.throttle(res, req, xThroughput)
 
-				log.Debug().Msg("File " + xResponseFile + " not found in " + path)
-				return nil
-			})
-
-			switch fmt.Sprintf("%v", err) {
-			case "INVALID_PATH_ERROR":
-				xStatusCode = http.StatusBadRequest
-			case "FILE_ACCESS_ERROR":
-				xStatusCode = http.StatusInternalServerError
-			case "FILE_FOUND":
-				xStatusCode = http.StatusOK
-			}
-		} else {
-			xData = req.Header.Get("X-Erised-Data")
-			log.Debug().Msg("X-Erised-Data: " + xData)
+		if err != nil {
+			log.Error().Msg(err.Error())
+			http.Error(res, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		res.WriteHeader(xStatusCode)
-		srv.respond(res, encoding, delay, xData)
+		rw.WriteHeader(xStatusCode)
+		srv.respond(rw, encoding, delay, xData)
 		log.Debug().Msg("leaving handleLanding")
 	}
 }
@@ -226,6 +238,236 @@ func (srv *server) handleIP() http.HandlerFunc {
 	}
 }
 
+func (srv *server) handleMocksAPI() http.HandlerFunc {
+	log.Debug().Msg("entering handleMocksAPI")
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		log.Info().
+			Str("protocol", req.Proto).
+			Str("remoteAddress", req.RemoteAddr).
+			Str("method", req.Method).
+			Str("host", req.Host).
+			Str("path", req.RequestURI).
+			Msg("handleMocksAPI")
+
+		id := req.PathValue("id")
+		res.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case req.Method == http.MethodGet && id == "":
+			data, _ := json.Marshal(srv.mck.list())
+			srv.respond(res, encodingJSON, 0, string(data))
+		case req.Method == http.MethodGet:
+			if rule := srv.mck.get(id); rule != nil {
+				data, _ := json.Marshal(rule)
+				srv.respond(res, encodingJSON, 0, string(data))
+			} else {
+				http.Error(res, "Not Found", http.StatusNotFound)
+			}
+		case req.Method == http.MethodPost && id == "":
+			body := &bytes.Buffer{}
+
+			if _, err := body.ReadFrom(req.Body); err != nil {
+				log.Error().Msg("Error reading request body")
+				log.Debug().Msg(fmt.Sprintf("Error: %v", err))
+				http.Error(res, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+
+			rules, err := parseMocks(body.Bytes())
+
+			if err != nil {
+				log.Error().Msg("Invalid mock definition: " + err.Error())
+				http.Error(res, "Bad Request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if err = srv.mck.add(rules...); err != nil {
+				log.Error().Msg(err.Error())
+				http.Error(res, "Conflict: "+err.Error(), http.StatusConflict)
+				return
+			}
+
+			data, _ := json.Marshal(rules)
+			res.WriteHeader(http.StatusCreated)
+			srv.respond(res, encodingJSON, 0, string(data))
+		case req.Method == http.MethodPut && id != "":
+			body := &bytes.Buffer{}
+
+			if _, err := body.ReadFrom(req.Body); err != nil {
+				log.Error().Msg("Error reading request body")
+				log.Debug().Msg(fmt.Sprintf("Error: %v", err))
+				http.Error(res, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+
+			rules, err := parseMocks(body.Bytes())
+
+			if err == nil && len(rules) != 1 {
+				err = errors.New("exactly one mock is required")
+			}
+
+			if err != nil {
+				log.Error().Msg("Invalid mock definition: " + err.Error())
+				http.Error(res, "Bad Request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if !srv.mck.replace(id, rules[0]) {
+				http.Error(res, "Not Found", http.StatusNotFound)
+				return
+			}
+
+			data, _ := json.Marshal(rules[0])
+			srv.respond(res, encodingJSON, 0, string(data))
+		case req.Method == http.MethodDelete && id == "":
+			srv.mck.clear()
+			res.WriteHeader(http.StatusNoContent)
+		case req.Method == http.MethodDelete:
+			if srv.mck.remove(id) {
+				res.WriteHeader(http.StatusNoContent)
+			} else {
+				http.Error(res, "Not Found", http.StatusNotFound)
+			}
+		default:
+			log.Error().Msg("Method " + req.Method + " not allowed for " + req.URL.Path)
+			http.Error(res, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+
+		log.Debug().Msg("leaving handleMocksAPI")
+	}
+}
+
+func (srv *server) handleRequests() http.HandlerFunc {
+	log.Debug().Msg("entering handleRequests")
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		log.Info().
+			Str("protocol", req.Proto).
+			Str("remoteAddress", req.RemoteAddr).
+			Str("method", req.Method).
+			Str("host", req.Host).
+			Str("path", req.RequestURI).
+			Msg("handleRequests")
+
+		if srv.jnl == nil {
+			log.Error().Msg("Request journal is disabled")
+			http.Error(res, "Not Found", http.StatusNotFound)
+			return
+		}
+
+		switch req.Method {
+		case http.MethodGet:
+			flt := journalFilter{
+				Method:  req.URL.Query().Get("method"),
+				Path:    req.URL.Query().Get("path"),
+				Headers: map[string]string{},
+				Mock:    req.URL.Query().Get("mock"),
+			}
+
+			for _, h := range req.URL.Query()["header"] {
+				if k, v, ok := strings.Cut(h, ":"); ok {
+					flt.Headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+				}
+			}
+
+			res.Header().Set("Content-Type", "application/json")
+			data, _ := json.Marshal(srv.jnl.list(flt))
+			srv.respond(res, encodingJSON, 0, string(data))
+		case http.MethodDelete:
+			srv.jnl.clear()
+			res.WriteHeader(http.StatusNoContent)
+		default:
+			log.Error().Msg("Method " + req.Method + " not allowed for /erised/requests")
+			http.Error(res, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+
+		log.Debug().Msg("leaving handleRequests")
+	}
+}
+
+func (srv *server) handleRequestsCount() http.HandlerFunc {
+	log.Debug().Msg("entering handleRequestsCount")
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		log.Info().
+			Str("protocol", req.Proto).
+			Str("remoteAddress", req.RemoteAddr).
+			Str("method", req.Method).
+			Str("host", req.Host).
+			Str("path", req.RequestURI).
+			Msg("handleRequestsCount")
+
+		if req.Method != http.MethodPost {
+			log.Error().Msg("Method " + req.Method + " not allowed for /erised/requests/count")
+			http.Error(res, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if srv.jnl == nil {
+			log.Error().Msg("Request journal is disabled")
+			http.Error(res, "Not Found", http.StatusNotFound)
+			return
+		}
+
+		var flt journalFilter
+
+		if err := json.NewDecoder(req.Body).Decode(&flt); err != nil && !errors.Is(err, io.EOF) {
+			log.Error().Msg("Invalid request criteria: " + err.Error())
+			http.Error(res, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		res.Header().Set("Content-Type", "application/json")
+		srv.respond(res, encodingJSON, 0, "{\"count\":"+strconv.Itoa(len(srv.jnl.list(flt)))+"}")
+		log.Debug().Msg("leaving handleRequestsCount")
+	}
+}
+
+func (srv *server) handleScenarios() http.HandlerFunc {
+	log.Debug().Msg("entering handleScenarios")
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		log.Info().
+			Str("protocol", req.Proto).
+			Str("remoteAddress", req.RemoteAddr).
+			Str("method", req.Method).
+			Str("host", req.Host).
+			Str("path", req.RequestURI).
+			Msg("handleScenarios")
+
+		name := req.PathValue("name")
+
+		switch {
+		case req.Method == http.MethodGet && name == "":
+			res.Header().Set("Content-Type", "application/json")
+			data, _ := json.Marshal(srv.mck.scenarios())
+			srv.respond(res, encodingJSON, 0, string(data))
+		case req.Method == http.MethodPut && name != "":
+			var body struct {
+				State string `json:"state"`
+			}
+
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.State == "" {
+				log.Error().Msg("Invalid scenario state")
+				http.Error(res, "Bad Request: a JSON object with the new state is required", http.StatusBadRequest)
+				return
+			}
+
+			srv.mck.setState(name, body.State)
+			res.WriteHeader(http.StatusNoContent)
+		case req.Method == http.MethodDelete:
+			srv.mck.reset(name)
+			res.WriteHeader(http.StatusNoContent)
+		default:
+			log.Error().Msg("Method " + req.Method + " not allowed for " + req.URL.Path)
+			http.Error(res, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+
+		log.Debug().Msg("leaving handleScenarios")
+	}
+}
+
 func (srv *server) handleShutdown() http.HandlerFunc {
 	log.Debug().Msg("entering handleShutdown")
 
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// defaults for /erised/sse when no script is given
+const (
+	sseTicks    = 10
+	sseMaxTicks = 10000
+	sseInterval = 1000
+)
+
+type sseEvent struct {
+	ID      mockBody `json:"id,omitempty"`
+	Event   string   `json:"event,omitempty"`
+	Data    mockBody `json:"data,omitempty"`
+	Retry   int      `json:"retry,omitempty"`
+	Comment string   `json:"comment,omitempty"`
+	Raw     string   `json:"raw,omitempty"`
+	Delay   int      `json:"delay,omitempty"`
+}
+
+// parseEvents accepts a JSON list of events or a single event. An empty script is an empty stream
+func parseEvents(script string) ([]*sseEvent, error) {
+	var events []*sseEvent
+
+	if script = strings.TrimSpace(script); script == "" {
+		return events, nil
+	}
+
+	if strings.HasPrefix(script, "{") {
+		script = "[" + script + "]"
+	}
+
+	if err := json.Unmarshal([]byte(script), &events); err != nil {
+		return nil, errors.New("invalid event script: " + err.Error())
+	}
+
+	for i, ev := range events {
+		if ev == nil {
+			return nil, errors.New("event #" + strconv.Itoa(i+1) + " is empty")
+		}
+
+		if ev.Delay < 0 || ev.Retry < 0 {
+			return nil, errors.New("event #" + strconv.Itoa(i+1) + ": delay and retry cannot be negative")
+		}
+
+		if strings.ContainsAny(string(ev.ID)+ev.Event, "\r\n") {
+			return nil, errors.New("event #" + strconv.Itoa(i+1) + ": id and event cannot span lines")
+		}
+	}
+
+	return events, nil
+}
+
+// String encodes the event in the text/event-stream format. Raw events are sent verbatim,
+// which allows sending partial or malformed frames
+func (ev *sseEvent) String() string {
+	if ev.Raw != "" {
+		return ev.Raw
+	}
+
+	sb := strings.Builder{}
+
+	if ev.Comment != "" {
+		for _, line := range strings.Split(ev.Comment, "\n") {
+			sb.WriteString(": " + line + "\n")
+		}
+	}
+
+	if ev.ID != "" {
+		sb.WriteString("id: " + string(ev.ID) + "\n")
+	}
+
+	if ev.Event != "" {
+		sb.WriteString("event: " + ev.Event + "\n")
+	}
+
+	if ev.Retry > 0 {
+		sb.WriteString("retry: " + strconv.Itoa(ev.Retry) + "\n")
+	}
+
+	if ev.Data != "" {
+		for _, line := range strings.Split(strings.ReplaceAll(string(ev.Data), "\r\n", "\n"), "\n") {
+			sb.WriteString("data: " + line + "\n")
+		}
+	}
+
+	if sb.Len() == 0 {
+		return ""
+	}
+
+	return sb.String() + "\n"
+}
+
+// stream sends the events, flushing after each one. When the client reconnects with Last-Event-ID,
+// the stream resumes after the event with that id
+func (srv *server) stream(res http.ResponseWriter, req *http.Request, status int, delay time.Duration, events []*sseEvent) {
+	log.Debug().Msg("entering stream")
+	rc := http.NewResponseController(res)
+
+	// streams usually outlive the -write timeout
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Error().Msg(err.Error())
+	}
+
+	if lastID := req.Header.Get("Last-Event-ID"); lastID != "" {
+		for i, ev := range events {
+			if string(ev.ID) == lastID {
+				log.Debug().Msg("Resuming stream after event " + lastID)
+				events = events[i+1:]
+				break
+			}
+		}
+	}
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.Header().Del("Content-Length")
+	res.WriteHeader(status)
+
+	if !srv.pause(req, delay) {
+		return
+	}
+
+	if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Error().Msg(err.Error())
+		return
+	}
+
+	for _, ev := range events {
+		if !srv.pause(req, time.Duration(ev.Delay)*time.Millisecond) {
+			log.Info().Msg("Client closed the event stream")
+			return
+		}
+
+		if _, err := io.WriteString(res, ev.String()); err != nil {
+			log.Error().Msg(err.Error())
+			return
+		}
+
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Error().Msg(err.Error())
+			return
+		}
+	}
+
+	log.Debug().Msg("leaving stream")
+}
+
+// pause waits for the delay, returning false if the client goes away in the meantime
+func (srv *server) pause(req *http.Request, delay time.Duration) bool {
+	if delay <= 0 {
+		return req.Context().Err() == nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+func (srv *server) handleSSE() http.HandlerFunc {
+	log.Debug().Msg("entering handleSSE")
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		log.Info().
+			Str("protocol", req.Proto).
+			Str("remoteAddress", req.RemoteAddr).
+			Str("method", req.Method).
+			Str("host", req.Host).
+			Str("path", req.RequestURI).
+			Msg("handleSSE")
+
+		if req.Method != http.MethodGet && req.Method != http.MethodPost {
+			log.Error().Msg("Method " + req.Method + " not allowed for /erised/sse")
+			http.Error(res, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		script := ""
+
+		if req.Method == http.MethodPost {
+			body, err := io.ReadAll(req.Body)
+
+			if err != nil {
+				log.Error().Msg("Error reading request body: " + err.Error())
+				http.Error(res, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+
+			script = string(body)
+		}
+
+		if xResponseFile := req.Header.Get("X-Erised-Response-File"); script == "" && xResponseFile != "" && srv.pth != "" {
+			data, status := srv.responseFile(xResponseFile)
+
+			if status != http.StatusOK {
+				http.Error(res, http.StatusText(status), status)
+				return
+			}
+
+			script = data
+		}
+
+		if script == "" {
+			script = req.Header.Get("X-Erised-Data")
+		}
+
+		var events []*sseEvent
+		var err error
+
+		if script == "" {
+			events, err = ticks(req.URL.Query().Get("count"), req.URL.Query().Get("interval"))
+		} else {
+			events, err = parseEvents(script)
+		}
+
+		if err != nil {
+			log.Error().Msg(err.Error())
+			http.Error(res, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		srv.stream(res, req, http.StatusOK, 0, events)
+		log.Debug().Msg("leaving handleSSE")
+	}
+}
+
+// ticks generates numbered events, sent every interval milliseconds
+func ticks(count, interval string) ([]*sseEvent, error) {
+	n, ms := sseTicks, sseInterval
+	var err error
+
+	if count != "" {
+		if n, err = strconv.Atoi(count); err != nil || n < 0 || n > sseMaxTicks {
+			return nil, errors.New("count must be a number between 0 and " + strconv.Itoa(sseMaxTicks))
+		}
+	}
+
+	if interval != "" {
+		if ms, err = strconv.Atoi(interval); err != nil || ms < 0 {
+			return nil, errors.New("interval must be a non-negative number of milliseconds")
+		}
+	}
+
+	events := make([]*sseEvent, 0, n)
+
+	for i := 1; i <= n; i++ {
+		delay := ms
+
+		if i == 1 {
+			delay = 0
+		}
+
+		events = append(events, &sseEvent{
+			ID:    mockBody(strconv.Itoa(i)),
+			Event: "tick",
+			Data:  mockBody(`{"tick":` + strconv.Itoa(i) + `}`),
+			Delay: delay,
+		})
+	}
+
+	return events, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+)
+
+func TestErisedSSE(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	svr := server{mck: &mockStore{}}
+	script := `[{"id":1,"event":"greeting","data":"Hello\nWorld","retry":3000},{"id":"2","data":{"Hello":"World"}},{"comment":"keep-alive"},{"raw":"data: partial"}]`
+	exp := "id: 1\nevent: greeting\nretry: 3000\ndata: Hello\ndata: World\n\n" +
+		"id: 2\ndata: {\"Hello\":\"World\"}\n\n" +
+		": keep-alive\n\n" +
+		"data: partial"
+
+	g.Describe("Test event scripts", func() {
+		g.It("Should encode events", func() {
+			events, err := parseEvents(script)
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(events).Should(HaveLen(4))
+
+			data := ""
+
+			for _, ev := range events {
+				data += ev.String()
+			}
+
+			Ω(data).Should(Equal(exp))
+		})
+
+		g.It("Should accept a single event", func() {
+			events, err := parseEvents(`{"data":"Hello"}`)
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(events[0].String()).Should(Equal("data: Hello\n\n"))
+		})
+
+		g.It("Should reject invalid scripts", func() {
+			_, err := parseEvents(`[{"data":"Hello","delay":-1}]`)
+			Ω(err).Should(HaveOccurred())
+
+			_, err = parseEvents(`[{"event":"a\nb"}]`)
+			Ω(err).Should(HaveOccurred())
+
+			_, err = parseEvents(`Hello`)
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	g.Describe("Test erised/sse", func() {
+		g.It("Should stream the scripted events", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/erised/sse", strings.NewReader(script))
+			svr.handleSSE().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(res.Header().Get("Content-Type")).Should(Equal("text/event-stream"))
+			Ω(res.Header().Get("Cache-Control")).Should(Equal("no-cache"))
+			Ω(res.Body.String()).Should(Equal(exp))
+			Ω(res.Flushed).Should(BeTrue())
+		})
+
+		g.It("Should resume after Last-Event-ID", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/erised/sse", nil)
+			req.Header.Set("X-Erised-Data", script)
+			req.Header.Set("Last-Event-ID", "1")
+			svr.handleSSE().ServeHTTP(res, req)
+
+			Ω(res.Body.String()).Should(HavePrefix("id: 2\n"))
+		})
+
+		g.It("Should stream ticks without a script", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/erised/sse?count=3&interval=0", nil)
+			svr.handleSSE().ServeHTTP(res, req)
+
+			Ω(strings.Count(res.Body.String(), "event: tick\n")).Should(Equal(3))
+			Ω(res.Body.String()).Should(HaveSuffix("id: 3\nevent: tick\ndata: {\"tick\":3}\n\n"))
+		})
+
+		g.It("Should return BadRequest for invalid scripts", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/erised/sse?count=many", nil)
+			svr.handleSSE().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusBadRequest))
+
+			res = httptest.NewRecorder()
+			req = httptest.NewRequest(http.MethodGet, "http://localhost:8080/erised/sse?count=2000000000", nil)
+			svr.handleSSE().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusBadRequest))
+		})
+
+		g.It("Should return MethodNotAllowed", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodDelete, "http://localhost:8080/erised/sse", nil)
+			svr.handleSSE().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusMethodNotAllowed))
+		})
+
+		g.It("Should flush each event as it is sent", func() {
+			ts := httptest.NewServer(svr.handleSSE())
+			defer ts.Close()
+			req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+			req.Header.Set("X-Erised-Data", `[{"id":1,"data":"first"},{"id":2,"data":"second","delay":2000}]`)
+			start := time.Now()
+			resp, err := http.DefaultClient.Do(req)
+
+			Ω(err).ShouldNot(HaveOccurred())
+			defer func() { _ = resp.Body.Close() }()
+			line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+
+			Ω(line).Should(Equal("id: 1\n"))
+			Ω(time.Since(start)).Should(BeNumerically("<", time.Second))
+		})
+	})
+
+	g.Describe("Test event streams from / and mocks", func() {
+		g.It("Should stream X-Erised-Data", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/", nil)
+			req.Header.Set("X-Erised-Content-Type", "sse")
+			req.Header.Set("X-Erised-Data", `[{"data":"Hello"}]`)
+			svr.handleLanding().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(res.Header().Get("Content-Type")).Should(Equal("text/event-stream"))
+			Ω(res.Body.String()).Should(Equal("data: Hello\n\n"))
+		})
+
+		g.It("Should return BadRequest for invalid X-Erised-Data", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/", nil)
+			req.Header.Set("X-Erised-Content-Type", "sse")
+			req.Header.Set("X-Erised-Data", `Hello`)
+			svr.handleLanding().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusBadRequest))
+		})
+
+		g.It("Should stream mock bodies", func() {
+			rules, err := parseMocks([]byte(`{"path":"/events","contentType":"sse","body":[{"event":"ping","data":"pong"}]}`))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(svr.mck.add(rules...)).Should(Succeed())
+
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/events", nil)
+			svr.handleMocks(svr.handleLanding()).ServeHTTP(res, req)
+
+			Ω(res.Header().Get("Content-Type")).Should(Equal("text/event-stream"))
+			Ω(res.Body.String()).Should(Equal("event: ping\ndata: pong\n\n"))
+		})
+	})
+}
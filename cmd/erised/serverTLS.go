@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":    tls.NoClientCert,
+	"request": tls.RequestClientCert,
+	"require": tls.RequireAnyClientCert,
+	"verify":  tls.RequireAndVerifyClientCert,
+}
+
+type tlsInfo struct {
+	Version            string             `json:"version"`
+	CipherSuite        string             `json:"cipherSuite"`
+	Protocol           string             `json:"protocol"`
+	ServerName         string             `json:"serverName"`
+	Resumed            bool               `json:"resumed"`
+	Verified           bool               `json:"verified"`
+	ClientCertificates []*certificateInfo `json:"clientCertificates"`
+}
+
+type certificateInfo struct {
+	Subject        string    `json:"subject"`
+	Issuer         string    `json:"issuer"`
+	Serial         string    `json:"serial"`
+	NotBefore      time.Time `json:"notBefore"`
+	NotAfter       time.Time `json:"notAfter"`
+	DNSNames       []string  `json:"dnsNames,omitempty"`
+	IPAddresses    []string  `json:"ipAddresses,omitempty"`
+	EmailAddresses []string  `json:"emailAddresses,omitempty"`
+	URIs           []string  `json:"uris,omitempty"`
+	Fingerprint    string    `json:"sha256"`
+}
+
+// setupClientAuth sets how client certificates are requested and which CAs are trusted to issue them
+func (srv *server) setupClientAuth(caFile, mode string) error {
+	log.Debug().Msg("entering setupClientAuth")
+	auth, ok := clientAuthTypes[mode]
+
+	if !ok {
+		return errors.New("invalid client authentication mode " + mode)
+	}
+
+	if auth == tls.RequireAndVerifyClientCert && caFile == "" {
+		return errors.New("verifying client certificates requires a client CA")
+	}
+
+	if srv.cfg.TLSConfig == nil {
+		srv.cfg.TLSConfig = &tls.Config{}
+	}
+
+	srv.cfg.TLSConfig.ClientAuth = auth
+
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.New("no certificates found in " + caFile)
+		}
+
+		srv.cfg.TLSConfig.ClientCAs = pool
+	}
+
+	log.Info().Str("clientAuth", mode).Str("clientCA", caFile).Msg("Client authentication enabled")
+	log.Debug().Msg("leaving setupClientAuth")
+	return nil
+}
+
+func (srv *server) handleTLS() http.HandlerFunc {
+	log.Debug().Msg("entering handleTLS")
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		log.Info().
+			Str("protocol", req.Proto).
+			Str("remoteAddress", req.RemoteAddr).
+			Str("method", req.Method).
+			Str("host", req.Host).
+			Str("path", req.RequestURI).
+			Msg("handleTLS")
+
+		if req.Method != http.MethodGet {
+			log.Error().Msg("Method " + req.Method + " not allowed for /erised/tls")
+			http.Error(res, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if req.TLS == nil {
+			log.Error().Msg("/erised/tls requested over a plain connection")
+			http.Error(res, "Bad Request: not a TLS connection", http.StatusBadRequest)
+			return
+		}
+
+		info := &tlsInfo{
+			Version:            tls.VersionName(req.TLS.Version),
+			CipherSuite:        tls.CipherSuiteName(req.TLS.CipherSuite),
+			Protocol:           req.TLS.NegotiatedProtocol,
+			ServerName:         req.TLS.ServerName,
+			Resumed:            req.TLS.DidResume,
+			Verified:           len(req.TLS.VerifiedChains) > 0,
+			ClientCertificates: make([]*certificateInfo, 0, len(req.TLS.PeerCertificates)),
+		}
+
+		for _, cert := range req.TLS.PeerCertificates {
+			info.ClientCertificates = append(info.ClientCertificates, describeCertificate(cert))
+		}
+
+		// when the mode does not verify certificates, report whether they would have been trusted
+		if !info.Verified && len(req.TLS.PeerCertificates) > 0 && srv.cfg.TLSConfig != nil && srv.cfg.TLSConfig.ClientCAs != nil {
+			intermediates := x509.NewCertPool()
+
+			for _, cert := range req.TLS.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+
+			_, err := req.TLS.PeerCertificates[0].Verify(x509.VerifyOptions{
+				Roots:         srv.cfg.TLSConfig.ClientCAs,
+				Intermediates: intermediates,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			})
+			info.Verified = err == nil
+		}
+
+		data, _ := json.Marshal(info)
+		res.Header().Set("Content-Type", "application/json")
+		srv.respond(res, encodingJSON, 0, string(data))
+		log.Debug().Msg("leaving handleTLS")
+	}
+}
+
+func describeCertificate(cert *x509.Certificate) *certificateInfo {
+	fingerprint := sha256.Sum256(cert.Raw)
+	info := &certificateInfo{
+		Subject:        cert.Subject.String(),
+		Issuer:         cert.Issuer.String(),
+		Serial:         cert.SerialNumber.String(),
+		NotBefore:      cert.NotBefore,
+		NotAfter:       cert.NotAfter,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		Fingerprint:    hex.EncodeToString(fingerprint[:]),
+	}
+
+	for _, ip := range cert.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+
+	for _, uri := range cert.URIs {
+		info.URIs = append(info.URIs, uri.String())
+	}
+
+	return info
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type tlsFault struct {
+	Name        string `json:"name"`
+	Port        int    `json:"port"`
+	Description string `json:"description"`
+	config      *tls.Config
+	server      *http.Server
+}
+
+type tlsFaults struct {
+	CA     string      `json:"ca"`
+	Faults []*tlsFault `json:"faults"`
+}
+
+// newTLSFaults creates an in-memory CA, and one TLS setup for each known-bad configuration
+func newTLSFaults() (*tlsFaults, error) {
+	log.Debug().Msg("entering newTLSFaults")
+	now := time.Now()
+	root, err := newCertificate(certSpec{CommonName: "Erised TLS Faults CA", IsCA: true}, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	intermediate, err := newCertificate(certSpec{CommonName: "Erised TLS Faults Intermediate CA", IsCA: true}, root)
+
+	if err != nil {
+		return nil, err
+	}
+
+	untrusted, err := newCertificate(certSpec{CommonName: "Erised Untrusted CA", IsCA: true}, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	faults := []struct {
+		name, description string
+		spec              certSpec
+		issuer            *certificate
+		version           uint16
+	}{
+		{"expired", "Certificate expired a day ago",
+			certSpec{CommonName: "expired", Hosts: localHosts, NotBefore: now.AddDate(0, -1, 0), NotAfter: now.AddDate(0, 0, -1)}, root, 0},
+		{"wrong-host", "Certificate issued for wrong.host.invalid",
+			certSpec{CommonName: "wrong-host", Hosts: []string{"wrong.host.invalid"}}, root, 0},
+		{"self-signed", "Self-signed certificate",
+			certSpec{CommonName: "self-signed", Hosts: localHosts}, nil, 0},
+		{"untrusted-root", "Certificate issued by an untrusted CA",
+			certSpec{CommonName: "untrusted-root", Hosts: localHosts}, untrusted, 0},
+		{"weak-key", "Certificate with a 1024 bit RSA key",
+			certSpec{CommonName: "weak-key", Hosts: localHosts, KeyType: keyRSA, KeyBits: 1024}, root, 0},
+		{"tls-1.0", "Only TLS 1.0 is supported",
+			certSpec{CommonName: "tls-1.0", Hosts: localHosts}, root, tls.VersionTLS10},
+		{"missing-intermediate", "Certificate issued by an intermediate CA that is not sent",
+			certSpec{CommonName: "missing-intermediate", Hosts: localHosts}, intermediate, 0},
+	}
+
+	flt := &tlsFaults{CA: string(root.certPEM())}
+
+	for _, f := range faults {
+		leaf, err := newCertificate(f.spec, f.issuer)
+
+		if err != nil {
+			return nil, errors.New(f.name + ": " + err.Error())
+		}
+
+		cfg := &tls.Config{Certificates: []tls.Certificate{leaf.tlsCertificate()}}
+
+		if f.version != 0 {
+			cfg.MinVersion, cfg.MaxVersion = f.version, f.version
+		}
+
+		flt.Faults = append(flt.Faults, &tlsFault{Name: f.name, Description: f.description, config: cfg})
+	}
+
+	log.Debug().Msg("leaving newTLSFaults")
+	return flt, nil
+}
+
+// startTLSFaults listens on consecutive ports starting at port, or on random ports when port is 0,
+// serving the same handlers as the main server over HTTP/1.1 with each faulty TLS setup
+func (srv *server) startTLSFaults(port int) error {
+	log.Debug().Msg("entering startTLSFaults")
+	flt, err := newTLSFaults()
+
+	if err != nil {
+		return err
+	}
+
+	srv.flt = flt
+
+	for i, f := range flt.Faults {
+		addr := ":0"
+
+		if port != 0 {
+			addr = ":" + strconv.Itoa(port+i)
+		}
+
+		lis, err := net.Listen("tcp", addr)
+
+		if err != nil {
+			srv.stopTLSFaults()
+			return err
+		}
+
+		f.Port = lis.Addr().(*net.TCPAddr).Port
+		f.server = &http.Server{
+			Handler:      srv.handleJournal(srv.mux),
+			TLSConfig:    f.config,
+			TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){},
+			ReadTimeout:  srv.cfg.ReadTimeout,
+			WriteTimeout: srv.cfg.WriteTimeout,
+			IdleTimeout:  srv.cfg.IdleTimeout,
+		}
+
+		go func(f *tlsFault) {
+			if err := f.server.ServeTLS(lis, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error().Str("fault", f.Name).Msg("TLS fault server shutdown error: " + err.Error())
+			}
+		}(f)
+
+		log.Info().Str("fault", f.Name).Int("port", f.Port).Msg("TLS fault server running")
+	}
+
+	log.Debug().Msg("leaving startTLSFaults")
+	return nil
+}
+
+func (srv *server) stopTLSFaults() {
+	if srv.flt == nil {
+		return
+	}
+
+	for _, f := range srv.flt.Faults {
+		if f.server != nil {
+			_ = f.server.Close()
+		}
+	}
+}
+
+func (srv *server) handleTLSFaults() http.HandlerFunc {
+	log.Debug().Msg("entering handleTLSFaults")
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		log.Info().
+			Str("protocol", req.Proto).
+			Str("remoteAddress", req.RemoteAddr).
+			Str("method", req.Method).
+			Str("host", req.Host).
+			Str("path", req.RequestURI).
+			Msg("handleTLSFaults")
+
+		if req.Method != http.MethodGet {
+			log.Error().Msg("Method " + req.Method + " not allowed for /erised/tls/faults")
+			http.Error(res, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if srv.flt == nil {
+			http.Error(res, "Not Found: TLS faults are disabled", http.StatusNotFound)
+			return
+		}
+
+		data, _ := json.Marshal(srv.flt)
+		res.Header().Set("Content-Type", "application/json")
+		srv.respond(res, encodingJSON, 0, string(data))
+		log.Debug().Msg("leaving handleTLSFaults")
+	}
+}
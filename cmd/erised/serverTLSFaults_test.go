@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+)
+
+func TestErisedTLSFaults(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	svr := newServer(8080, 5, 10, 120, 10, "")
+
+	g.Describe("Test TLS fault listeners", func() {
+		var roots *x509.CertPool
+		ports := map[string]int{}
+
+		g.Before(func() {
+			Ω(svr.startTLSFaults(0)).Should(Succeed())
+			roots = x509.NewCertPool()
+			Ω(roots.AppendCertsFromPEM([]byte(svr.flt.CA))).Should(BeTrue())
+
+			for _, f := range svr.flt.Faults {
+				ports[f.Name] = f.Port
+			}
+		})
+
+		g.After(func() {
+			svr.stopTLSFaults()
+		})
+
+		get := func(name string, cfg *tls.Config) (*http.Response, error) {
+			if cfg == nil {
+				cfg = &tls.Config{RootCAs: roots, ServerName: "localhost"}
+			}
+
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+			res, err := client.Get("https://127.0.0.1:" + strconv.Itoa(ports[name]) + "/erised/info")
+
+			if err == nil {
+				_ = res.Body.Close()
+			}
+
+			return res, err
+		}
+
+		g.It("Should list every fault", func() {
+			Ω(ports).Should(HaveLen(7))
+			Ω(ports).Should(HaveKey("expired"))
+			Ω(ports).Should(HaveKey("missing-intermediate"))
+		})
+
+		g.It("Should serve an expired certificate", func() {
+			_, err := get("expired", nil)
+			Ω(err).Should(MatchError(ContainSubstring("expired")))
+		})
+
+		g.It("Should serve a certificate for the wrong host", func() {
+			_, err := get("wrong-host", nil)
+			Ω(err).Should(MatchError(ContainSubstring("not localhost")))
+		})
+
+		g.It("Should serve certificates from unknown authorities", func() {
+			for _, name := range []string{"self-signed", "untrusted-root", "missing-intermediate"} {
+				_, err := get(name, nil)
+				Ω(err).Should(MatchError(ContainSubstring("unknown authority")))
+			}
+		})
+
+		g.It("Should serve a weak RSA key", func() {
+			var key *rsa.PublicKey
+			res, err := get("weak-key", &tls.Config{
+				RootCAs:    roots,
+				ServerName: "localhost",
+				VerifyConnection: func(cs tls.ConnectionState) error {
+					key, _ = cs.PeerCertificates[0].PublicKey.(*rsa.PublicKey)
+					return nil
+				},
+			})
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(key.N.BitLen()).Should(Equal(1024))
+		})
+
+		g.It("Should only accept TLS 1.0", func() {
+			_, err := get("tls-1.0", nil)
+			Ω(err).Should(MatchError(ContainSubstring("protocol version")))
+
+			res, err := get("tls-1.0", &tls.Config{RootCAs: roots, ServerName: "localhost", MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS10})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(res.TLS.Version).Should(Equal(uint16(tls.VersionTLS10)))
+		})
+	})
+
+	g.Describe("Test erised/tls/faults", func() {
+		g.It("Should describe the TLS faults", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/erised/tls/faults", nil)
+			svr.handleTLSFaults().ServeHTTP(res, req)
+			flt := &tlsFaults{}
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(json.NewDecoder(res.Body).Decode(flt)).Should(Succeed())
+			Ω(flt.CA).Should(HavePrefix("-----BEGIN CERTIFICATE-----"))
+			Ω(flt.Faults).Should(HaveLen(7))
+			Ω(flt.Faults[0].Name).Should(Equal("expired"))
+			Ω(flt.Faults[0].Port).ShouldNot(BeZero())
+		})
+
+		g.It("Should return NotFound when disabled", func() {
+			srv := &server{cfg: &http.Server{}}
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/erised/tls/faults", nil)
+			srv.handleTLSFaults().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusNotFound))
+		})
+
+		g.It("Should return MethodNotAllowed", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/erised/tls/faults", nil)
+			svr.handleTLSFaults().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusMethodNotAllowed))
+		})
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+)
+
+func TestErisedTLS(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	pem, _ := os.ReadFile("certs/localCA.pem")
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pem)
+	pair, _ := tls.LoadX509KeyPair("certs/erised.crt", "certs/erised.key")
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "Self Signed Client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	selfSigned := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	start := func(caFile, mode string) *httptest.Server {
+		svr := &server{cfg: &http.Server{}}
+		Ω(svr.setupClientAuth(caFile, mode)).Should(Succeed())
+		ts := httptest.NewUnstartedServer(svr.handleTLS())
+		ts.TLS = svr.cfg.TLSConfig.Clone()
+		ts.TLS.Certificates = []tls.Certificate{pair}
+		ts.StartTLS()
+		return ts
+	}
+	get := func(ts *httptest.Server, certs ...tls.Certificate) (*tlsInfo, error) {
+		// always present the certificate, even when it was not issued by one of the accepted CAs
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:    roots,
+			ServerName: "localhost",
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				if len(certs) == 0 {
+					return &tls.Certificate{}, nil
+				}
+
+				return &certs[0], nil
+			},
+		}}}
+		res, err := client.Get(ts.URL + "/erised/tls")
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer func() { _ = res.Body.Close() }()
+		info := &tlsInfo{}
+		return info, json.NewDecoder(res.Body).Decode(info)
+	}
+
+	g.Describe("Test client authentication", func() {
+		g.It("Should reject invalid settings", func() {
+			svr := &server{cfg: &http.Server{}}
+
+			Ω(svr.setupClientAuth("", "always")).ShouldNot(Succeed())
+			Ω(svr.setupClientAuth("", "verify")).ShouldNot(Succeed())
+			Ω(svr.setupClientAuth("certs/erised.ext", "verify")).ShouldNot(Succeed())
+			Ω(svr.setupClientAuth("certs/missing.pem", "request")).ShouldNot(Succeed())
+		})
+
+		g.It("Should describe the connection without client certificates", func() {
+			ts := start("", "none")
+			defer ts.Close()
+			info, err := get(ts, pair)
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(info.Version).Should(Equal("TLS 1.3"))
+			Ω(info.CipherSuite).ShouldNot(BeEmpty())
+			Ω(info.ServerName).Should(Equal("localhost"))
+			Ω(info.Verified).Should(BeFalse())
+			Ω(info.ClientCertificates).Should(BeEmpty())
+		})
+
+		g.It("Should verify client certificates", func() {
+			ts := start("certs/localCA.pem", "verify")
+			defer ts.Close()
+			info, err := get(ts, pair)
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(info.Verified).Should(BeTrue())
+			Ω(info.ClientCertificates).Should(HaveLen(1))
+			Ω(info.ClientCertificates[0].Subject).Should(ContainSubstring("CN=Erised Test Certificate"))
+			Ω(info.ClientCertificates[0].Issuer).Should(ContainSubstring("CN=Erised Test CA"))
+			Ω(info.ClientCertificates[0].DNSNames).Should(Equal([]string{"localhost"}))
+			Ω(info.ClientCertificates[0].Fingerprint).Should(HaveLen(64))
+
+			_, err = get(ts)
+			Ω(err).Should(HaveOccurred())
+
+			_, err = get(ts, selfSigned)
+			Ω(err).Should(HaveOccurred())
+		})
+
+		g.It("Should require any client certificate", func() {
+			ts := start("certs/localCA.pem", "require")
+			defer ts.Close()
+			info, err := get(ts, selfSigned)
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(info.Verified).Should(BeFalse())
+			Ω(info.ClientCertificates[0].Subject).Should(Equal("CN=Self Signed Client"))
+			Ω(info.ClientCertificates[0].Serial).Should(Equal("42"))
+
+			info, err = get(ts, pair)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(info.Verified).Should(BeTrue())
+
+			_, err = get(ts)
+			Ω(err).Should(HaveOccurred())
+		})
+
+		g.It("Should request client certificates", func() {
+			ts := start("", "request")
+			defer ts.Close()
+			info, err := get(ts)
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(info.ClientCertificates).Should(BeEmpty())
+
+			info, err = get(ts, selfSigned)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(info.ClientCertificates).Should(HaveLen(1))
+		})
+	})
+
+	g.Describe("Test erised/tls", func() {
+		g.It("Should return BadRequest over plain connections", func() {
+			svr := &server{cfg: &http.Server{}}
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/erised/tls", nil)
+			svr.handleTLS().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusBadRequest))
+		})
+
+		g.It("Should return MethodNotAllowed", func() {
+			svr := &server{cfg: &http.Server{}}
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "https://localhost:8443/erised/tls", nil)
+			svr.handleTLS().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusMethodNotAllowed))
+		})
+	})
+}
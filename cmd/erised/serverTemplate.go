@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/rs/zerolog/log"
+)
+
+type templateRequest struct {
+	Method string
+	Path   string
+	Host   string
+	Body   string
+	Query  map[string]string
+	Header map[string]string
+	Params map[string]string
+}
+
+type templateData struct {
+	Request templateRequest
+}
+
+var templateFuncs = template.FuncMap{
+	"jsonPath": func(body, expr string) (interface{}, error) {
+		var doc interface{}
+		// numbers are kept as written, so large IDs aren't rendered in e-notation
+		dec := json.NewDecoder(strings.NewReader(body))
+		dec.UseNumber()
+
+		if err := dec.Decode(&doc); err != nil || dec.Decode(&struct{}{}) != io.EOF {
+			return nil, errors.New("body is not valid JSON")
+		}
+
+		v, ok, err := evalJSONPath(doc, expr)
+
+		if err != nil || !ok {
+			return "", err
+		}
+
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			data, err := json.Marshal(v)
+			return string(data), err
+		default:
+			return v, nil
+		}
+	},
+}
+
+// render executes data as a text/template using the request as input
+func render(data string, req *http.Request, params map[string]string) (string, error) {
+	log.Debug().Msg("entering render")
+	tpl, err := template.New("response").Funcs(templateFuncs).Option("missingkey=zero").Parse(data)
+
+	if err != nil {
+		return "", err
+	}
+
+	body, err := io.ReadAll(req.Body)
+
+	if err != nil {
+		return "", err
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	td := templateData{Request: templateRequest{
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Host:   req.Host,
+		Body:   string(body),
+		Query:  map[string]string{},
+		Header: map[string]string{},
+		Params: params,
+	}}
+
+	for k, v := range req.URL.Query() {
+		td.Request.Query[k] = v[0]
+	}
+
+	for k, v := range req.Header {
+		td.Request.Header[k] = v[0]
+	}
+
+	buf := &bytes.Buffer{}
+
+	if err = tpl.Execute(buf, td); err != nil {
+		return "", err
+	}
+
+	log.Debug().Msg("leaving render")
+	return buf.String(), nil
+}
+
+type jsonPathStep struct {
+	key string
+	idx int
+}
+
+// parseJSONPath supports the $.name, $['name'] and $[n] subset of JSONPath
+func parseJSONPath(expr string) ([]jsonPathStep, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, errors.New("JSONPath must start with $: " + expr)
+	}
+
+	steps := make([]jsonPathStep, 0)
+	rest := expr[1:]
+
+	for rest != "" {
+		step := jsonPathStep{idx: -1}
+
+		switch {
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+
+			if end < 0 {
+				end = len(rest)
+			}
+
+			step.key, rest = rest[:end], rest[end:]
+
+			if step.key == "" {
+				return nil, errors.New("invalid JSONPath: " + expr)
+			}
+		case strings.HasPrefix(rest, "['"):
+			end := strings.Index(rest, "']")
+
+			if end < 0 {
+				return nil, errors.New("invalid JSONPath: " + expr)
+			}
+
+			step.key, rest = rest[2:end], rest[end+2:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+
+			if end < 0 {
+				return nil, errors.New("invalid JSONPath: " + expr)
+			}
+
+			n, err := strconv.Atoi(rest[1:end])
+
+			if err != nil || n < 0 {
+				return nil, errors.New("invalid JSONPath index: " + expr)
+			}
+
+			step.idx, rest = n, rest[end+1:]
+		default:
+			return nil, errors.New("invalid JSONPath: " + expr)
+		}
+
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+// evalJSONPath returns the value selected by expr and whether it exists in doc
+func evalJSONPath(doc interface{}, expr string) (interface{}, bool, error) {
+	steps, err := parseJSONPath(expr)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, step := range steps {
+		if step.idx >= 0 {
+			if list, ok := doc.([]interface{}); ok && step.idx < len(list) {
+				doc = list[step.idx]
+				continue
+			}
+
+			return nil, false, nil
+		}
+
+		if obj, ok := doc.(map[string]interface{}); ok {
+			if doc, ok = obj[step.key]; ok {
+				continue
+			}
+		}
+
+		return nil, false, nil
+	}
+
+	return doc, true, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+)
+
+func TestErisedTemplates(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	svr := server{mck: &mockStore{}}
+	_ = svr.mck.add(&mockRule{Path: "/users/{id}", mockResponse: mockResponse{Body: `{"id":"{{.Request.Params.id}}"}`, Template: true}})
+	_ = svr.mck.add(&mockRule{Path: "/literal", mockResponse: mockResponse{Body: `{{.Request.Path}}`}})
+
+	g.Describe("Test response templates", func() {
+		g.It("Should render request data", func() {
+			exp := `/users?id=7 Bearer token 12345678901`
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/users?id=7", strings.NewReader(`{"user":{"id":12345678901}}`))
+			req.Header.Set("Authorization", "Bearer token")
+			req.Header.Set("X-Erised-Template", "true")
+			req.Header.Set("X-Erised-Data", `{{.Request.Path}}?id={{.Request.Query.id}} {{.Request.Header.Authorization}} {{jsonPath .Request.Body "$.user.id"}}`)
+			svr.handleLanding().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(res.Body.String()).Should(Equal(exp))
+		})
+
+		g.It("Should not render unless enabled", func() {
+			exp := `{{.Request.Path}}`
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/", nil)
+			req.Header.Set("X-Erised-Data", exp)
+			svr.handleLanding().ServeHTTP(res, req)
+
+			Ω(res.Body.String()).Should(Equal(exp))
+
+			res = httptest.NewRecorder()
+			req = httptest.NewRequest(http.MethodGet, "http://localhost:8080/literal", nil)
+			svr.handleMocks(svr.handleLanding()).ServeHTTP(res, req)
+
+			Ω(res.Body.String()).Should(Equal(exp))
+		})
+
+		g.It("Should render mock path parameters", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/users/7", nil)
+			svr.handleMocks(svr.handleLanding()).ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(res.Body.String()).Should(Equal(`{"id":"7"}`))
+		})
+
+		g.It("Should return InternalServerError for invalid templates", func() {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/", nil)
+			req.Header.Set("X-Erised-Template", "true")
+			req.Header.Set("X-Erised-Data", `{{.Request.Path`)
+			svr.handleLanding().ServeHTTP(res, req)
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusInternalServerError))
+		})
+	})
+
+	g.Describe("Test JSONPath", func() {
+		doc := map[string]interface{}{"a": map[string]interface{}{"b c": []interface{}{"x", "y"}}}
+
+		g.It("Should evaluate expressions", func() {
+			v, ok, err := evalJSONPath(doc, "$.a['b c'][1]")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ok).Should(BeTrue())
+			Ω(v).Should(Equal("y"))
+
+			_, ok, err = evalJSONPath(doc, "$.a.z")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ok).Should(BeFalse())
+
+			_, _, err = evalJSONPath(doc, "a.b")
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// throughput sends the body in chunks of the given size, one every interval
+type throughput struct {
+	chunk    int
+	interval time.Duration
+}
+
+// throttledWriter streams the body slowly, flushing every chunk. The status is held back until the body
+// is written, so the Content-Length can be declared and clients can report their progress. Bodies
+// streamed in several writes, e.g. by proxies, keep the headers they have
+type throttledWriter struct {
+	http.ResponseWriter
+	srv        *server
+	req        *http.Request
+	rate       *throughput
+	status     int
+	streamed   bool
+	headerSent bool
+	started    bool
+}
+
+// parseThroughput accepts a number of bytes per second, or a chunk size and the interval between chunks
+// separated by a slash, e.g. 512/250ms
+func parseThroughput(value string) (*throughput, error) {
+	size, interval, found := strings.Cut(strings.TrimSpace(value), "/")
+	n, err := strconv.Atoi(strings.TrimSpace(size))
+
+	if err != nil || n <= 0 {
+		return nil, errors.New("invalid throughput " + value + ", use bytes per second or <chunk size>/<interval>")
+	}
+
+	if !found {
+		chunk := max(n/10, 1)
+		return &throughput{chunk: chunk, interval: time.Second * time.Duration(chunk) / time.Duration(n)}, nil
+	}
+
+	d, err := time.ParseDuration(strings.TrimSpace(interval))
+
+	if err != nil || d <= 0 {
+		return nil, errors.New("invalid throughput interval " + interval)
+	}
+
+	return &throughput{chunk: n, interval: d}, nil
+}
+
+// throttle limits the throughput of the response when value is set. On errors the response is returned as is
+func (srv *server) throttle(res http.ResponseWriter, req *http.Request, value string) (http.ResponseWriter, error) {
+	if value == "" {
+		return res, nil
+	}
+
+	rate, err := parseThroughput(value)
+
+	if err != nil {
+		return res, err
+	}
+
+	log.Debug().Int("chunk", rate.chunk).Str("interval", rate.interval.String()).Msg("Throttling response")
+
+	// slow transfers usually outlive the -write timeout
+	if err = http.NewResponseController(res).SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Error().Msg(err.Error())
+	}
+
+	return &throttledWriter{ResponseWriter: res, srv: srv, req: req, rate: rate}, nil
+}
+
+func (tw *throttledWriter) WriteHeader(status int) {
+	// informational responses aren't followed by a body
+	if status < http.StatusOK {
+		tw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	if tw.status == 0 {
+		tw.status = status
+	}
+
+	if tw.streamed {
+		tw.writeHeader(0)
+	}
+}
+
+func (tw *throttledWriter) writeHeader(length int) {
+	if tw.headerSent {
+		return
+	}
+
+	tw.headerSent = true
+
+	// compressed bodies are written in several parts, so their length is unknown
+	if !tw.streamed && tw.Header().Get("Content-Length") == "" && tw.Header().Get("Content-Encoding") == "" {
+		tw.Header().Set("Content-Length", strconv.Itoa(length))
+	}
+
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+
+	tw.ResponseWriter.WriteHeader(tw.status)
+}
+
+func (tw *throttledWriter) Write(data []byte) (int, error) {
+	tw.writeHeader(len(data))
+	written := 0
+
+	for len(data) > 0 {
+		if tw.started && !tw.srv.pause(tw.req, tw.rate.interval) {
+			return written, tw.req.Context().Err()
+		}
+
+		tw.started = true
+		n, err := tw.ResponseWriter.Write(data[:min(tw.rate.chunk, len(data))])
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+
+		if err = http.NewResponseController(tw.ResponseWriter).Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return written, err
+		}
+
+		data = data[n:]
+	}
+
+	return written, nil
+}
+
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+func (tw *throttledWriter) Flush() {
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok && tw.headerSent {
+		f.Flush()
+	}
+}
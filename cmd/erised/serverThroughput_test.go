@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+)
+
+func TestErisedThroughput(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	svr := &server{mck: &mockStore{}}
+	ts := httptest.NewServer(svr.handleMocks(svr.handleLanding()))
+	defer ts.Close()
+
+	get := func(path string, headers map[string]string) (*http.Response, string, time.Duration) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+
+		start := time.Now()
+		res, err := http.DefaultClient.Do(req)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer func() { _ = res.Body.Close() }()
+		body, err := io.ReadAll(res.Body)
+		Ω(err).ShouldNot(HaveOccurred())
+		return res, string(body), time.Since(start)
+	}
+
+	g.Describe("Test throughput parsing", func() {
+		g.It("Should accept bytes per second", func() {
+			rate, err := parseThroughput("1000")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(rate.chunk).Should(Equal(100))
+			Ω(rate.interval).Should(Equal(100 * time.Millisecond))
+
+			rate, err = parseThroughput("5")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(rate.chunk).Should(Equal(1))
+			Ω(rate.interval).Should(Equal(200 * time.Millisecond))
+		})
+
+		g.It("Should accept a chunk size and interval", func() {
+			rate, err := parseThroughput("512/250ms")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(rate.chunk).Should(Equal(512))
+			Ω(rate.interval).Should(Equal(250 * time.Millisecond))
+		})
+
+		g.It("Should reject invalid values", func() {
+			for _, value := range []string{"fast", "0", "-10", "512/", "512/soon", "512/0s", "/1s"} {
+				_, err := parseThroughput(value)
+				Ω(err).Should(HaveOccurred(), value)
+			}
+		})
+	})
+
+	g.Describe("Test slow responses", func() {
+		g.It("Should stream the body in chunks", func() {
+			res, body, elapsed := get("/", map[string]string{"X-Erised-Data": "0123456789", "X-Erised-Throughput": "2/50ms",
+				"X-Erised-Status-Code": "Teapot"})
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusTeapot))
+			Ω(res.ContentLength).Should(BeEquivalentTo(10))
+			Ω(body).Should(Equal("0123456789"))
+			Ω(elapsed).Should(BeNumerically(">=", 200*time.Millisecond))
+		})
+
+		g.It("Should keep the delay separate from the throughput", func() {
+			req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+			req.Header.Set("X-Erised-Data", "0123456789")
+			req.Header.Set("X-Erised-Response-Delay", "100")
+			req.Header.Set("X-Erised-Throughput", "5/200ms")
+
+			start := time.Now()
+			res, err := http.DefaultClient.Do(req)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer func() { _ = res.Body.Close() }()
+			firstByte := time.Since(start)
+			_, _ = io.ReadAll(res.Body)
+
+			Ω(firstByte).Should(BeNumerically(">=", 100*time.Millisecond))
+			Ω(firstByte).Should(BeNumerically("<", 200*time.Millisecond))
+			Ω(time.Since(start)).Should(BeNumerically(">=", 300*time.Millisecond))
+		})
+
+		g.It("Should throttle compressed bodies", func() {
+			res, body, _ := get("/", map[string]string{"X-Erised-Data": "Hello World", "X-Erised-Content-Type": "gzip",
+				"X-Erised-Throughput": "8/10ms"})
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(res.Uncompressed).Should(BeTrue())
+			Ω(body).Should(Equal("Hello World"))
+		})
+
+		g.It("Should return BadRequest for invalid values", func() {
+			res, body, _ := get("/", map[string]string{"X-Erised-Data": "Hello World", "X-Erised-Throughput": "fast"})
+
+			Ω(res).Should(HaveHTTPStatus(http.StatusBadRequest))
+			Ω(body).Should(ContainSubstring("invalid throughput"))
+		})
+
+		g.It("Should throttle mock responses", func() {
+			rules, err := parseMocks([]byte("- path: /slow\n  throughput: 4/50ms\n  body: " + strings.Repeat("x", 12) + "\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(svr.mck.add(rules...)).Should(Succeed())
+
+			res, body, elapsed := get("/slow", nil)
+			Ω(res.ContentLength).Should(BeEquivalentTo(12))
+			Ω(body).Should(HaveLen(12))
+			Ω(elapsed).Should(BeNumerically(">=", 100*time.Millisecond))
+
+			_, err = parseMocks([]byte("- path: /\n  throughput: fast\n"))
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+}
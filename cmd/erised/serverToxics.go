@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	toxicLatency   = "latency"
+	toxicBandwidth = "bandwidth"
+	toxicStatus    = "status"
+	toxicCorrupt   = "corrupt"
+	toxicReset     = "reset"
+)
+
+var toxicTypes = map[string]bool{
+	toxicLatency:   true,
+	toxicBandwidth: true,
+	toxicStatus:    true,
+	toxicCorrupt:   true,
+	toxicReset:     true,
+}
+
+type toxicsKey struct{}
+
+// toxic degrades the traffic proxied to the upstream. Toxicity is the probability, between 0 and 1,
+// of the toxic applying to a request
+type toxic struct {
+	Name     string     `json:"name"`
+	Type     string     `json:"type"`
+	Toxicity float64    `json:"toxicity"`
+	Latency  int        `json:"latency,omitempty"`
+	Jitter   int        `json:"jitter,omitempty"`
+	Rate     string     `json:"rate,omitempty"`
+	Status   statusCode `json:"status,omitempty"`
+	Bytes    int        `json:"bytes,omitempty"`
+}
+
+// toxicProxy forwards every request to a real service, applying the toxics in place
+type toxicProxy struct {
+	target *url.URL
+	proxy  *httputil.ReverseProxy
+	mtx    sync.RWMutex
+	toxics []*toxic
+}
+
+// parseToxics reads a toxic, or a list of them, in YAML or JSON. Toxics apply to every request unless
+// their toxicity is set
+func parseToxics(data []byte) ([]*toxic, error) {
+	var raw interface{}
+
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	if m, ok := raw.(map[string]interface{}); ok {
+		raw = []interface{}{m}
+	}
+
+	items, ok := raw.([]interface{})
+
+	if !ok || len(items) == 0 {
+		return nil, errors.New("no toxics found")
+	}
+
+	toxics := make([]*toxic, 0, len(items))
+
+	for i, item := range items {
+		buf, err := json.Marshal(item)
+
+		if err != nil {
+			return nil, err
+		}
+
+		t := &toxic{Toxicity: 1}
+
+		if err = json.Unmarshal(buf, t); err != nil {
+			return nil, errors.New("toxic #" + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+
+		if err = t.validate(); err != nil {
+			return nil, errors.New("toxic #" + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+
+		toxics = append(toxics, t)
+	}
+
+	return toxics, nil
+}
+
+func (t *toxic) validate() error {
+	if t.Type = strings.ToLower(t.Type); !toxicTypes[t.Type] {
+		return errors.New("unknown toxic type " + t.Type + ", use latency/bandwidth/status/corrupt/reset")
+	}
+
+	if t.Name == "" {
+		t.Name = t.Type
+	}
+
+	if t.Toxicity < 0 || t.Toxicity > 1 {
+		return errors.New("toxicity must be between 0 and 1")
+	}
+
+	switch t.Type {
+	case toxicLatency:
+		if t.Latency < 0 || t.Jitter < 0 {
+			return errors.New("latency and jitter cannot be negative")
+		}
+	case toxicBandwidth:
+		if _, err := parseThroughput(t.Rate); err != nil {
+			return err
+		}
+	case toxicStatus:
+		// informational statuses would leave the client waiting for the final response
+		if t.Status < 200 || t.Status > 599 {
+			return errors.New("invalid status " + strconv.Itoa(int(t.Status)) + ", use 200 to 599")
+		}
+	case toxicCorrupt:
+		if t.Bytes < 0 {
+			return errors.New("bytes cannot be negative")
+		}
+
+		if t.Bytes == 0 {
+			t.Bytes = 1
+		}
+	}
+
+	return nil
+}
+
+func (srv *server) setupUpstream(upstream string) error {
+	log.Debug().Msg("entering setupUpstream")
+	target, err := url.Parse(upstream)
+
+	if err != nil {
+		return err
+	}
+
+	if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return errors.New("invalid upstream " + upstream + ", an absolute http or https URL is required")
+	}
+
+	srv.tox = &toxicProxy{target: target}
+	srv.tox.proxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.SetXForwarded()
+		},
+		ModifyResponse: srv.poison,
+		ErrorHandler: func(res http.ResponseWriter, req *http.Request, err error) {
+			log.Error().Msg("Upstream error: " + err.Error())
+			http.Error(res, "Bad Gateway", http.StatusBadGateway)
+		},
+	}
+
+	log.Info().Str("upstream", target.String()).Msg("upstream mode enabled")
+	log.Debug().Msg("leaving setupUpstream")
+	return nil
+}
+
+// add stores all toxics or none of them
+func (tp *toxicProxy) add(toxics ...*toxic) error {
+	tp.mtx.Lock()
+	defer tp.mtx.Unlock()
+	names := map[string]bool{}
+
+	for _, t := range toxics {
+		if names[t.Name] || tp.index(t.Name) >= 0 {
+			return errors.New("toxic " + t.Name + " already exists")
+		}
+
+		names[t.Name] = true
+	}
+
+	tp.toxics = append(tp.toxics, toxics...)
+	return nil
+}
+
+// index must be called with the lock held
+func (tp *toxicProxy) index(name string) int {
+	for i, t := range tp.toxics {
+		if t.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (tp *toxicProxy) list() []*toxic {
+	tp.mtx.RLock()
+	defer tp.mtx.RUnlock()
+
+	return append([]*toxic{}, tp.toxics...)
+}
+
+func (tp *toxicProxy) get(name string) *toxic {
+	tp.mtx.RLock()
+	defer tp.mtx.RUnlock()
+
+	if i := tp.index(name); i >= 0 {
+		return tp.toxics[i]
+	}
+
+	return nil
+}
+
+// replace swaps the toxic in place, keeping its name
+func (tp *toxicProxy) replace(name string, t *toxic) bool {
+	tp.mtx.Lock()
+	defer tp.mtx.Unlock()
+
+	if i := tp.index(name); i >= 0 {
+		t.Name = name
+		tp.toxics[i] = t
+		return true
+	}
+
+	return false
+}
+
+func (tp *toxicProxy) remove(name string) bool {
+	tp.mtx.Lock()
+	defer tp.mtx.Unlock()
+
+	if i := tp.index(name); i >= 0 {
+		tp.toxics = append(tp.toxics[:i], tp.toxics[i+1:]...)
+		return true
+	}
+
+	return false
+}
+
+func (tp *toxicProxy) clear() {
+	tp.mtx.Lock()
+	defer tp.mtx.Unlock()
+
+	tp.toxics = nil
+}
+
+// active draws the toxics applying to a request, according to their toxicity
+func (tp *toxicProxy) active(rnd *random) []*toxic {
+	tp.mtx.RLock()
+	defer tp.mtx.RUnlock()
+	var toxics []*toxic
+
+	for _, t := range tp.toxics {
+		if t.Toxicity > 0 && rnd.float64() < t.Toxicity {
+			toxics = append(toxics, t)
+		}
+	}
+
+	return toxics
+}
+
+func (srv *server) handleUpstream(next http.HandlerFunc) http.HandlerFunc {
+	log.Debug().Msg("entering handleUpstream")
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		if srv.tox == nil {
+			next(res, req)
+			return
+		}
+
+		log.Info().
+			Str("protocol", req.Proto).
+			Str("remoteAddress", req.RemoteAddr).
+			Str("method", req.Method).
+			Str("host", req.Host).
+			Str("path", req.RequestURI).
+			Msg("handleUpstream")
+
+		toxics := srv.tox.active(srv.rnd)
+		delay := time.Duration(0)
+		names := []string{}
+		reset := false
+
+		for _, t := range toxics {
+			names = append(names, t.Name)
+
+			switch t.Type {
+			case toxicReset:
+				setFault(req, faultReset)
+				reset = true
+			case toxicLatency:
+				jitter := (srv.rnd.float64()*2 - 1) * float64(t.Jitter)
+				delay += time.Duration(max(float64(t.Latency)+jitter, 0) * float64(time.Millisecond))
+			case toxicBandwidth:
+				if rw, err := srv.throttle(res, req, t.Rate); err == nil {
+					rw.(*throttledWriter).streamed = true
+					res = rw
+				}
+			}
+		}
+
+		if len(toxics) > 0 {
+			log.Warn().Strs("toxics", names).Str("path", req.RequestURI).Msg("Applying toxics")
+
+			if entry := requestEntry(req); entry != nil {
+				entry.Toxics = names
+			}
+		}
+
+		// a reset connection never reaches the upstream
+		if reset {
+			log.Debug().Msg("leaving handleUpstream")
+			return
+		}
+
+		if !srv.pause(req, delay) {
+			return
+		}
+
+		srv.tox.proxy.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), toxicsKey{}, toxics)))
+		log.Debug().Msg("leaving handleUpstream")
+	}
+}
+
+// poison replaces the status and corrupts the body of upstream responses, as the toxics of the request say
+func (srv *server) poison(resp *http.Response) error {
+	toxics, _ := resp.Request.Context().Value(toxicsKey{}).([]*toxic)
+
+	for _, t := range toxics {
+		switch t.Type {
+		case toxicStatus:
+			resp.StatusCode = int(t.Status)
+			resp.Status = strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode)
+		case toxicCorrupt:
+			body, err := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+
+			if err != nil {
+				return err
+			}
+
+			// flipping bits keeps the length of the body, so the damage goes unnoticed by the transport
+			for i := 0; i < t.Bytes && len(body) > 0; i++ {
+				body[int(srv.rnd.float64()*float64(len(body)))] ^= byte(1 + srv.rnd.float64()*255)
+			}
+
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+		}
+	}
+
+	return nil
+}
+
+func (srv *server) handleToxicsAPI() http.HandlerFunc {
+	log.Debug().Msg("entering handleToxicsAPI")
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		log.Info().
+			Str("protocol", req.Proto).
+			Str("remoteAddress", req.RemoteAddr).
+			Str("method", req.Method).
+			Str("host", req.Host).
+			Str("path", req.RequestURI).
+			Msg("handleToxicsAPI")
+
+		if srv.tox == nil {
+			log.Error().Msg("Upstream mode is disabled")
+			http.Error(res, "Not Found", http.StatusNotFound)
+			return
+		}
+
+		name := req.PathValue("name")
+		res.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case req.Method == http.MethodGet && name == "":
+			data, _ := json.Marshal(srv.tox.list())
+			srv.respond(res, encodingJSON, 0, string(data))
+		case req.Method == http.MethodGet:
+			if t := srv.tox.get(name); t != nil {
+				data, _ := json.Marshal(t)
+				srv.respond(res, encodingJSON, 0, string(data))
+			} else {
+				http.Error(res, "Not Found", http.StatusNotFound)
+			}
+		case (req.Method == http.MethodPost && name == "") || (req.Method == http.MethodPut && name != ""):
+			body := &bytes.Buffer{}
+
+			if _, err := body.ReadFrom(req.Body); err != nil {
+				log.Error().Msg("Error reading request body")
+				http.Error(res, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+
+			toxics, err := parseToxics(body.Bytes())
+
+			if err == nil && name != "" && len(toxics) != 1 {
+				err = errors.New("exactly one toxic is required")
+			}
+
+			if err != nil {
+				log.Error().Msg("Invalid toxic: " + err.Error())
+				http.Error(res, "Bad Request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if name != "" {
+				if !srv.tox.replace(name, toxics[0]) {
+					http.Error(res, "Not Found", http.StatusNotFound)
+					return
+				}
+
+				data, _ := json.Marshal(toxics[0])
+				srv.respond(res, encodingJSON, 0, string(data))
+				break
+			}
+
+			if err = srv.tox.add(toxics...); err != nil {
+				log.Error().Msg(err.Error())
+				http.Error(res, "Conflict: "+err.Error(), http.StatusConflict)
+				return
+			}
+
+			data, _ := json.Marshal(toxics)
+			res.WriteHeader(http.StatusCreated)
+			srv.respond(res, encodingJSON, 0, string(data))
+		case req.Method == http.MethodDelete && name == "":
+			srv.tox.clear()
+			res.WriteHeader(http.StatusNoContent)
+		case req.Method == http.MethodDelete:
+			if srv.tox.remove(name) {
+				res.WriteHeader(http.StatusNoContent)
+			} else {
+				http.Error(res, "Not Found", http.StatusNotFound)
+			}
+		default:
+			log.Error().Msg("Method " + req.Method + " not allowed for " + req.URL.Path)
+			http.Error(res, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+
+		log.Debug().Msg("leaving handleToxicsAPI")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+)
+
+func TestErisedToxics(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	upstream := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("X-Upstream", req.URL.Path)
+		_, _ = io.WriteString(res, "0123456789")
+	}))
+	defer upstream.Close()
+
+	svr := &server{mck: &mockStore{}, jnl: newJournal(10), rnd: newRandom(1)}
+	svr.ctx, svr.stp = context.WithCancel(context.Background())
+	defer svr.stp()
+	svr.mux = &http.ServeMux{}
+	svr.mux.HandleFunc("/", svr.handleFaults(svr.handleUpstream(svr.handleMocks(svr.handleLanding()))))
+	svr.mux.HandleFunc("/erised/toxics", svr.handleToxicsAPI())
+	svr.mux.HandleFunc("/erised/toxics/{name}", svr.handleToxicsAPI())
+	ts := httptest.NewServer(svr.handleJournal(svr.mux))
+	defer ts.Close()
+
+	do := func(method, path, body string) (*http.Response, string, error) {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		res, err := client.Do(req)
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		defer func() { _ = res.Body.Close() }()
+		data, err := io.ReadAll(res.Body)
+		return res, string(data), err
+	}
+
+	g.Describe("Test toxics", func() {
+		g.It("Should parse toxics", func() {
+			toxics, err := parseToxics([]byte(`[{"type":"Latency","latency":100,"jitter":10},{"name":"flaky","type":"status","status":"ServiceUnavailable","toxicity":0.5}]`))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(toxics).Should(HaveLen(2))
+			Ω(toxics[0].Name).Should(Equal("latency"))
+			Ω(toxics[0].Toxicity).Should(Equal(1.0))
+			Ω(toxics[1].Status).Should(BeEquivalentTo(http.StatusServiceUnavailable))
+
+			toxics, err = parseToxics([]byte("type: corrupt\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(toxics[0].Bytes).Should(Equal(1))
+
+			for _, value := range []string{"", "[]", "type: poison", "type: latency\nlatency: -1", "type: bandwidth", "type: bandwidth\nrate: fast",
+				"type: status", "type: status\nstatus: 101", "type: reset\ntoxicity: 2", "type: corrupt\nbytes: -1"} {
+				_, err = parseToxics([]byte(value))
+				Ω(err).Should(HaveOccurred(), value)
+			}
+		})
+
+		g.It("Should return NotFound when upstream mode is disabled", func() {
+			res, _, err := do(http.MethodGet, "/erised/toxics", "")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(res).Should(HaveHTTPStatus(http.StatusNotFound))
+
+			res, body, _ := do(http.MethodGet, "/local", "")
+			Ω(res.Header.Get("X-Upstream")).Should(BeEmpty())
+			Ω(body).Should(BeEmpty())
+		})
+
+		g.It("Should forward every request to the upstream", func() {
+			Ω(svr.setupUpstream("localhost:9000")).ShouldNot(Succeed())
+			Ω(svr.setupUpstream(upstream.URL)).Should(Succeed())
+
+			res, body, err := do(http.MethodGet, "/orders/1", "")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(res.Header.Get("X-Upstream")).Should(Equal("/orders/1"))
+			Ω(body).Should(Equal("0123456789"))
+		})
+
+		g.It("Should manage toxics at runtime", func() {
+			res, _, _ := do(http.MethodPost, "/erised/toxics", `{"name":"down","type":"status","status":503}`)
+			Ω(res).Should(HaveHTTPStatus(http.StatusCreated))
+			res, _, _ = do(http.MethodPost, "/erised/toxics", `{"name":"down","type":"reset"}`)
+			Ω(res).Should(HaveHTTPStatus(http.StatusConflict))
+			res, _, _ = do(http.MethodPost, "/erised/toxics", `{"type":"meteor"}`)
+			Ω(res).Should(HaveHTTPStatus(http.StatusBadRequest))
+
+			res, body, _ := do(http.MethodGet, "/orders/2", "")
+			Ω(res).Should(HaveHTTPStatus(http.StatusServiceUnavailable))
+			Ω(body).Should(Equal("0123456789"))
+			entries := svr.jnl.list(journalFilter{Path: "/orders/2"})
+			Ω(entries).Should(HaveLen(1))
+			Ω(entries[0].Toxics).Should(Equal([]string{"down"}))
+			Ω(entries[0].Mock).Should(BeEmpty())
+
+			res, body, _ = do(http.MethodPut, "/erised/toxics/down", `{"type":"status","status":500,"toxicity":0}`)
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			Ω(body).Should(ContainSubstring(`"name":"down"`))
+			res, _, _ = do(http.MethodGet, "/orders/1", "")
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+
+			res, _, _ = do(http.MethodGet, "/erised/toxics/down", "")
+			Ω(res).Should(HaveHTTPStatus(http.StatusOK))
+			res, _, _ = do(http.MethodDelete, "/erised/toxics/down", "")
+			Ω(res).Should(HaveHTTPStatus(http.StatusNoContent))
+			res, _, _ = do(http.MethodGet, "/erised/toxics/down", "")
+			Ω(res).Should(HaveHTTPStatus(http.StatusNotFound))
+		})
+
+		g.It("Should add latency and limit the bandwidth", func() {
+			Ω(svr.tox.add(&toxic{Name: "slow", Type: toxicLatency, Toxicity: 1, Latency: 100, Jitter: 20},
+				&toxic{Name: "narrow", Type: toxicBandwidth, Toxicity: 1, Rate: "5/50ms"})).Should(Succeed())
+			defer svr.tox.clear()
+
+			start := time.Now()
+			res, body, err := do(http.MethodGet, "/", "")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(res.ContentLength).Should(BeEquivalentTo(10))
+			Ω(body).Should(Equal("0123456789"))
+			Ω(time.Since(start)).Should(BeNumerically(">=", 130*time.Millisecond))
+		})
+
+		g.It("Should corrupt the body", func() {
+			Ω(svr.tox.add(&toxic{Name: "noise", Type: toxicCorrupt, Toxicity: 1, Bytes: 3})).Should(Succeed())
+			defer svr.tox.clear()
+
+			_, body, err := do(http.MethodGet, "/", "")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(body).Should(HaveLen(10))
+			Ω(body).ShouldNot(Equal("0123456789"))
+		})
+
+		g.It("Should reset the connection", func() {
+			Ω(svr.tox.add(&toxic{Name: "reset", Type: toxicReset, Toxicity: 1})).Should(Succeed())
+			defer svr.tox.clear()
+
+			_, _, err := do(http.MethodGet, "/", "")
+			Ω(err).Should(HaveOccurred())
+		})
+
+		g.It("Should return BadGateway when the upstream is down", func() {
+			Ω(svr.setupUpstream("http://127.0.0.1:1")).Should(Succeed())
+
+			res, _, err := do(http.MethodGet, "/", "")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(res).Should(HaveHTTPStatus(http.StatusBadGateway))
+		})
+	})
+}
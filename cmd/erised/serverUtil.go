@@ -2,9 +2,13 @@ package main
 
 import (
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -16,6 +20,7 @@ const (
 	encodingXML
 	encodingGZIP
 	encodingHTML
+	encodingSSE
 )
 
 func elapsedTime(start time.Time, name string) {
@@ -96,11 +101,58 @@ func mimeType(code string) (int, string, string) {
 		return encodingGZIP, "application/octet-stream", "gzip"
 	case "html":
 		return encodingHTML, "text/html", ""
+	case "sse":
+		return encodingSSE, "text/event-stream", ""
 	default:
 		return encodingTEXT, "text/plain", ""
 	}
 }
 
+func (srv *server) responseFile(name string) (string, int) {
+	log.Debug().Msg("entering responseFile")
+	data := ""
+	status := http.StatusNotFound
+
+	err := filepath.WalkDir(srv.pth, func(path string, entry fs.DirEntry, err error) error {
+
+		if err != nil {
+			log.Error().Msg("Invalid path: " + path)
+			log.Debug().Msg(fmt.Sprintf("Error: %v", err))
+
+			return errors.New("INVALID_PATH_ERROR")
+		}
+
+		if !entry.IsDir() && filepath.Base(path) == name {
+			if ct, err := os.ReadFile(path); err != nil {
+				log.Error().Msg("Unable to open the file: " + path)
+				log.Debug().Msg(fmt.Sprintf("Error: %v", err))
+
+				return errors.New("FILE_ACCESS_ERROR")
+			} else {
+				log.Info().Msg(fmt.Sprintf("Reading file %v", path))
+				data = string(ct)
+
+				return errors.New("FILE_FOUND")
+			}
+		}
+
+		log.Debug().Msg("File " + name + " not found in " + path)
+		return nil
+	})
+
+	switch fmt.Sprintf("%v", err) {
+	case "INVALID_PATH_ERROR":
+		status = http.StatusBadRequest
+	case "FILE_ACCESS_ERROR":
+		status = http.StatusInternalServerError
+	case "FILE_FOUND":
+		status = http.StatusOK
+	}
+
+	log.Debug().Msg("leaving responseFile")
+	return data, status
+}
+
 func (srv *server) respond(res http.ResponseWriter, encoding int, delay time.Duration, data interface{}) {
 	log.Debug().Msg("entering respond")
 
@@ -114,7 +166,7 @@ func (srv *server) respond(res http.ResponseWriter, encoding int, delay time.Dur
 	}
 
 	switch encoding {
-	case encodingTEXT, encodingJSON, encodingXML, encodingHTML:
+	case encodingTEXT, encodingJSON, encodingXML, encodingHTML, encodingSSE:
 		if _, err := io.WriteString(res, fmt.Sprintf("%v", data)); err != nil {
 			log.Error().Msg(err.Error())
 		}
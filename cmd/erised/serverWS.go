@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// maximum time to wait for an expected message, unless the step sets its own timeout
+const wsTimeout = 10000
+
+type wsStep struct {
+	Send    *mockBody     `json:"send,omitempty"`
+	Binary  bool          `json:"binary,omitempty"`
+	Expect  *valueMatcher `json:"expect,omitempty"`
+	Timeout int           `json:"timeout,omitempty"`
+	Ping    *string       `json:"ping,omitempty"`
+	Close   int           `json:"close,omitempty"`
+	Reason  string        `json:"reason,omitempty"`
+	Delay   int           `json:"delay,omitempty"`
+}
+
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// parseSteps accepts a JSON list of steps or a single step. Each step sends, expects, pings or closes
+func parseSteps(script string) ([]*wsStep, error) {
+	var steps []*wsStep
+	script = strings.TrimSpace(script)
+
+	if strings.HasPrefix(script, "{") {
+		script = "[" + script + "]"
+	}
+
+	if err := json.Unmarshal([]byte(script), &steps); err != nil {
+		return nil, errors.New("invalid websocket script: " + err.Error())
+	}
+
+	for i, step := range steps {
+		if step == nil {
+			return nil, errors.New("step #" + strconv.Itoa(i+1) + " is empty")
+		}
+
+		if err := step.validate(); err != nil {
+			return nil, errors.New("step #" + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+	}
+
+	return steps, nil
+}
+
+func (step *wsStep) validate() error {
+	actions := 0
+
+	for _, set := range []bool{step.Send != nil, step.Expect != nil, step.Ping != nil, step.Close != 0} {
+		if set {
+			actions++
+		}
+	}
+
+	if actions != 1 {
+		return errors.New("exactly one of send, expect, ping or close is required")
+	}
+
+	if step.Delay < 0 || step.Timeout < 0 {
+		return errors.New("delay and timeout cannot be negative")
+	}
+
+	if step.Close != 0 && (step.Close < 1000 || step.Close > 4999) {
+		return errors.New("invalid close code " + strconv.Itoa(step.Close))
+	}
+
+	if len(step.Reason) > 123 {
+		return errors.New("close reason cannot be longer than 123 bytes")
+	}
+
+	if step.Expect != nil {
+		return step.Expect.compile()
+	}
+
+	return nil
+}
+
+// expects matches text against the expected value or regular expression, and JSON messages against expected objects
+func (step *wsStep) expects(msg []byte) bool {
+	if _, ok := step.Expect.Equals.(string); ok || step.Expect.re != nil {
+		return step.Expect.matchString(string(msg))
+	}
+
+	var v interface{}
+
+	if err := json.Unmarshal(msg, &v); err != nil {
+		return false
+	}
+
+	return step.Expect.matchValue(v)
+}
+
+func (srv *server) handleWS() http.HandlerFunc {
+	log.Debug().Msg("entering handleWS")
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		log.Info().
+			Str("protocol", req.Proto).
+			Str("remoteAddress", req.RemoteAddr).
+			Str("method", req.Method).
+			Str("host", req.Host).
+			Str("path", req.RequestURI).
+			Msg("handleWS")
+
+		// browsers cannot set headers on WebSocket requests, so the script can also be passed as a query parameter
+		script := req.URL.Query().Get("script")
+		xResponseFile := req.Header.Get("X-Erised-Response-File")
+
+		if file := req.URL.Query().Get("file"); file != "" {
+			xResponseFile = file
+		}
+
+		if script == "" && xResponseFile != "" && srv.pth != "" {
+			data, status := srv.responseFile(xResponseFile)
+
+			if status != http.StatusOK {
+				http.Error(res, http.StatusText(status), status)
+				return
+			}
+
+			script = data
+		}
+
+		if script == "" {
+			script = req.Header.Get("X-Erised-Data")
+		}
+
+		var steps []*wsStep
+
+		if script != "" {
+			var err error
+
+			if steps, err = parseSteps(script); err != nil {
+				log.Error().Msg(err.Error())
+				http.Error(res, "Bad Request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		upgrader := wsUpgrader
+		upgrader.Subprotocols = websocket.Subprotocols(req)
+		conn, err := upgrader.Upgrade(res, req, nil)
+
+		if err != nil {
+			// the upgrader has already replied to the client
+			log.Error().Msg("WebSocket upgrade failed: " + err.Error())
+			return
+		}
+
+		defer func() { _ = conn.Close() }()
+
+		if srv.converse(conn, steps) {
+			srv.echo(conn)
+		}
+
+		log.Debug().Msg("leaving handleWS")
+	}
+}
+
+// converse plays the script, returning false once the connection is closed
+func (srv *server) converse(conn *websocket.Conn, steps []*wsStep) bool {
+	for i, step := range steps {
+		if step.Delay > 0 {
+			time.Sleep(time.Duration(step.Delay) * time.Millisecond)
+		}
+
+		var err error
+
+		switch {
+		case step.Send != nil:
+			kind := websocket.TextMessage
+
+			if step.Binary {
+				kind = websocket.BinaryMessage
+			}
+
+			err = conn.WriteMessage(kind, []byte(*step.Send))
+		case step.Ping != nil:
+			err = conn.WriteControl(websocket.PingMessage, []byte(*step.Ping), time.Now().Add(time.Second))
+		case step.Close != 0:
+			log.Info().Int("code", step.Close).Str("reason", step.Reason).Msg("Closing WebSocket")
+			msg := websocket.FormatCloseMessage(step.Close, step.Reason)
+			_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			return false
+		case step.Expect != nil:
+			timeout := step.Timeout
+
+			if timeout == 0 {
+				timeout = wsTimeout
+			}
+
+			_ = conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Millisecond))
+			_, msg, rerr := conn.ReadMessage()
+			_ = conn.SetReadDeadline(time.Time{})
+
+			if rerr != nil {
+				var ne interface{ Timeout() bool }
+
+				if errors.As(rerr, &ne) && ne.Timeout() {
+					srv.closeWS(conn, "timeout waiting for step #"+strconv.Itoa(i+1))
+				}
+
+				err = rerr
+			} else if !step.expects(msg) {
+				srv.closeWS(conn, "unexpected message at step #"+strconv.Itoa(i+1))
+				return false
+			}
+		}
+
+		if err != nil {
+			log.Info().Msg("WebSocket closed: " + err.Error())
+			return false
+		}
+	}
+
+	return true
+}
+
+// closeWS ends a conversation that did not follow the script with a policy violation
+func (srv *server) closeWS(conn *websocket.Conn, reason string) {
+	log.Warn().Msg("WebSocket script failed: " + reason)
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+}
+
+// echo returns every text and binary message until the client closes the connection
+func (srv *server) echo(conn *websocket.Conn) {
+	for {
+		kind, msg, err := conn.ReadMessage()
+
+		if err != nil {
+			log.Info().Msg("WebSocket closed: " + err.Error())
+			return
+		}
+
+		if err = conn.WriteMessage(kind, msg); err != nil {
+			log.Error().Msg(err.Error())
+			return
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/gorilla/websocket"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+)
+
+func TestErisedWS(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+	svr := server{jnl: newJournal(10)}
+	ts := httptest.NewServer(svr.handleJournal(svr.handleWS()))
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	g.Describe("Test WebSocket scripts", func() {
+		g.It("Should accept valid scripts", func() {
+			steps, err := parseSteps(`[{"send":"Hello"},{"send":{"Hello":"World"},"binary":true},{"expect":{"matches":"^Hi"},"timeout":500},{"ping":""},{"close":4000,"reason":"bye"}]`)
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(steps).Should(HaveLen(5))
+			Ω(string(*steps[1].Send)).Should(Equal(`{"Hello":"World"}`))
+		})
+
+		g.It("Should reject invalid scripts", func() {
+			_, err := parseSteps(`[{"send":"Hello","close":1000}]`)
+			Ω(err).Should(HaveOccurred())
+
+			_, err = parseSteps(`[{"delay":100}]`)
+			Ω(err).Should(HaveOccurred())
+
+			_, err = parseSteps(`[{"close":999}]`)
+			Ω(err).Should(HaveOccurred())
+
+			_, err = parseSteps(`[{"expect":{"matches":"("}}]`)
+			Ω(err).Should(HaveOccurred())
+		})
+
+		g.It("Should match JSON messages", func() {
+			steps, _ := parseSteps(`{"expect":{"Hello":"World"}}`)
+
+			Ω(steps[0].expects([]byte(`{"Hello": "World"}`))).Should(BeTrue())
+			Ω(steps[0].expects([]byte(`{"Hello":"Moon"}`))).Should(BeFalse())
+		})
+	})
+
+	g.Describe("Test erised/ws", func() {
+		g.It("Should echo text and binary messages", func() {
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer func() { _ = conn.Close() }()
+
+			Ω(conn.WriteMessage(websocket.TextMessage, []byte("Hello"))).Should(Succeed())
+			kind, msg, err := conn.ReadMessage()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(kind).Should(Equal(websocket.TextMessage))
+			Ω(string(msg)).Should(Equal("Hello"))
+
+			Ω(conn.WriteMessage(websocket.BinaryMessage, []byte{0, 1, 2})).Should(Succeed())
+			kind, msg, err = conn.ReadMessage()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(kind).Should(Equal(websocket.BinaryMessage))
+			Ω(msg).Should(Equal([]byte{0, 1, 2}))
+		})
+
+		g.It("Should answer pings", func() {
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer func() { _ = conn.Close() }()
+			pong := make(chan string, 1)
+			conn.SetPongHandler(func(data string) error { pong <- data; return nil })
+
+			Ω(conn.WriteMessage(websocket.PingMessage, []byte("ping"))).Should(Succeed())
+			Ω(conn.WriteMessage(websocket.TextMessage, []byte("Hello"))).Should(Succeed())
+			_, _, err = conn.ReadMessage()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(<-pong).Should(Equal("ping"))
+		})
+
+		g.It("Should follow the script and close with its code", func() {
+			hdr := http.Header{}
+			hdr.Set("X-Erised-Data", `[{"send":"Welcome"},{"expect":"Hi"},{"send":"Bye","delay":10},{"close":4001,"reason":"done"}]`)
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL, hdr)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer func() { _ = conn.Close() }()
+
+			_, msg, err := conn.ReadMessage()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(msg)).Should(Equal("Welcome"))
+			Ω(conn.WriteMessage(websocket.TextMessage, []byte("Hi"))).Should(Succeed())
+			_, msg, err = conn.ReadMessage()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(msg)).Should(Equal("Bye"))
+			_, _, err = conn.ReadMessage()
+			Ω(websocket.IsCloseError(err, 4001)).Should(BeTrue())
+			Ω(err.(*websocket.CloseError).Text).Should(Equal("done"))
+		})
+
+		g.It("Should close with a policy violation on unexpected messages", func() {
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?script="+url.QueryEscape(`{"expect":"Hi"}`), nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer func() { _ = conn.Close() }()
+
+			Ω(conn.WriteMessage(websocket.TextMessage, []byte("Hello"))).Should(Succeed())
+			_, _, err = conn.ReadMessage()
+			Ω(websocket.IsCloseError(err, websocket.ClosePolicyViolation)).Should(BeTrue())
+		})
+
+		g.It("Should return BadRequest for invalid scripts", func() {
+			hdr := http.Header{}
+			hdr.Set("X-Erised-Data", `[{"send":"Hello","ping":""}]`)
+			_, resp, err := websocket.DefaultDialer.Dial(wsURL, hdr)
+
+			Ω(err).Should(HaveOccurred())
+			Ω(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+		})
+
+		g.It("Should record the upgrade in the journal", func() {
+			Eventually(func() []*journalEntry {
+				return svr.jnl.list(journalFilter{})
+			}).Should(ContainElement(HaveField("Status", http.StatusSwitchingProtocols)))
+		})
+	})
+}